@@ -0,0 +1,158 @@
+// Package archive extracts zip and tar packages preserving
+// symlinks and file metadata
+package archive
+
+import (
+  "context"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+type extractedDir struct {
+  path string
+  metadata *fsutil.FileMetadata
+}
+
+// Extract unpacks zip or tar (optionally gzipped) package into dest.
+// Metadata from the archive is applied according to mp
+func Extract(ctx context.Context, src, dest string, mp *fsutil.MetadataPolicy) error {
+  lower := strings.ToLower(src)
+
+  switch {
+  case strings.HasSuffix(lower, ".tar"),
+       strings.HasSuffix(lower, ".tar.gz"),
+       strings.HasSuffix(lower, ".tgz"):
+    return Untar(ctx, src, dest, mp)
+  }
+
+  return Unzip(ctx, src, dest, mp)
+}
+
+// prepareExtractedPath creates parent dirs of fullpath. Nothing is ever
+// written through symlinks extracted before: parents can not be symlinks
+// and a symlink at fullpath itself is replaced
+func prepareExtractedPath(dest, fullpath string) error {
+  err := fsutil.CheckNoSymlinkParents(fsutil.OS, dest, fullpath)
+  if err != nil {
+    return err
+  }
+
+  err = os.MkdirAll(filepath.Dir(fullpath), fsutil.DefaultDirMode)
+  if err != nil {
+    return err
+  }
+
+  if fi, err := os.Lstat(fullpath); err == nil && fsutil.IsSymlink(fi.Mode()) {
+    return os.Remove(fullpath)
+  }
+
+  return nil
+}
+
+func writeExtractedDir(dest, fullpath string) error {
+  err := prepareExtractedPath(dest, fullpath)
+  if err != nil {
+    return err
+  }
+
+  return os.MkdirAll(fullpath, fsutil.DefaultDirMode)
+}
+
+func writeExtractedFile(dest, fullpath string, r io.Reader, md *fsutil.FileMetadata, mp *fsutil.MetadataPolicy) error {
+  err := prepareExtractedPath(dest, fullpath)
+  if err != nil {
+    return err
+  }
+
+  out, err := os.OpenFile(fullpath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, fsutil.DefaultFileMode)
+  if err != nil {
+    return err
+  }
+
+  _, err = io.Copy(out, r)
+  if cerr := out.Close(); err == nil {
+    err = cerr
+  }
+
+  if err != nil {
+    return err
+  }
+
+  return mp.Apply(fsutil.OS, fullpath, md, false)
+}
+
+func writeExtractedSymlink(dest, fullpath, target string, md *fsutil.FileMetadata, mp *fsutil.MetadataPolicy) error {
+  relpath, err := filepath.Rel(dest, fullpath)
+  if err != nil {
+    return err
+  }
+
+  // links extracted later are checked together in validateExtractedLinks
+  if err = fsutil.ValidateLinkTarget(relpath, target, nil); err != nil {
+    return err
+  }
+
+  err = prepareExtractedPath(dest, fullpath)
+  if err != nil {
+    return err
+  }
+
+  return mp.CreateSymlink(fsutil.OS, target, fullpath, md)
+}
+
+// validateExtractedLinks checks all symlinks extracted into dest together
+// since they can point outside only in combination (like a -> . and b -> a/..)
+func validateExtractedLinks(dest string) error {
+  if _, err := os.Lstat(dest); os.IsNotExist(err) {
+    // nothing was extracted
+    return nil
+  }
+
+  links := make(map[string]string)
+
+  err := filepath.Walk(dest, func(fullpath string, info os.FileInfo, err error) error {
+    if err != nil || !fsutil.IsSymlink(info.Mode()) {
+      return err
+    }
+
+    relpath, err := filepath.Rel(dest, fullpath)
+    if err != nil {
+      return err
+    }
+
+    target, err := os.Readlink(fullpath)
+    if err != nil {
+      return err
+    }
+
+    links[filepath.ToSlash(relpath)] = target
+    return nil
+  })
+
+  if err != nil {
+    return err
+  }
+
+  return fsutil.ValidateLinks(links)
+}
+
+// applyDirsMetadata sets metadata of extracted directories
+// deepest first so parent mtimes are not touched afterwards
+func applyDirsMetadata(dirs []extractedDir, mp *fsutil.MetadataPolicy) error {
+  sort.Slice(dirs, func(i, j int) bool {
+    return len(dirs[i].path) > len(dirs[j].path)
+  })
+
+  for _, dir := range dirs {
+    err := mp.Apply(fsutil.OS, dir.path, dir.metadata, true)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,167 @@
+package archive
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "compress/gzip"
+  "context"
+  "io"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+// Create packs contents of srcDir into zip or tar (optionally gzipped)
+// archive depending on the extension of dest. Symlinks, permissions
+// and modification times are preserved
+func Create(ctx context.Context, srcDir, dest string) (err error) {
+  log.Printf("Packing %v into %v", srcDir, dest)
+
+  out, err := os.Create(dest)
+  if err != nil {
+    return err
+  }
+
+  defer func() {
+    if cerr := out.Close(); err == nil {
+      err = cerr
+    }
+
+    if err != nil {
+      os.Remove(dest)
+    }
+  }()
+
+  lower := strings.ToLower(dest)
+
+  switch {
+  case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+    gzw := gzip.NewWriter(out)
+    err = createTar(ctx, srcDir, gzw)
+    if cerr := gzw.Close(); err == nil {
+      err = cerr
+    }
+  case strings.HasSuffix(lower, ".tar"):
+    err = createTar(ctx, srcDir, out)
+  default:
+    err = createZip(ctx, srcDir, out)
+  }
+
+  return err
+}
+
+// walkArchived calls fn for everything under srcDir except the root
+// with slash-separated name of the entry in the archive
+func walkArchived(ctx context.Context, srcDir string, fn func(fullpath, name string, info os.FileInfo) error) error {
+  return filepath.Walk(srcDir, func(fullpath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+
+    relpath, err := filepath.Rel(srcDir, fullpath)
+    if err != nil || relpath == "." {
+      return err
+    }
+
+    return fn(fullpath, filepath.ToSlash(relpath), info)
+  })
+}
+
+func createZip(ctx context.Context, srcDir string, w io.Writer) error {
+  zw := zip.NewWriter(w)
+
+  err := walkArchived(ctx, srcDir, func(fullpath, name string, info os.FileInfo) error {
+    header, err := zip.FileInfoHeader(info)
+    if err != nil {
+      return err
+    }
+
+    header.Name = name
+    if info.IsDir() {
+      header.Name += "/"
+    } else {
+      header.Method = zip.Deflate
+    }
+
+    entry, err := zw.CreateHeader(header)
+    if err != nil || info.IsDir() {
+      return err
+    }
+
+    if fsutil.IsSymlink(info.Mode()) {
+      target, err := os.Readlink(fullpath)
+      if err != nil {
+        return err
+      }
+
+      _, err = io.WriteString(entry, filepath.ToSlash(target))
+      return err
+    }
+
+    return copyFileInto(entry, fullpath)
+  })
+
+  if cerr := zw.Close(); err == nil {
+    err = cerr
+  }
+
+  return err
+}
+
+func createTar(ctx context.Context, srcDir string, w io.Writer) error {
+  tw := tar.NewWriter(w)
+
+  err := walkArchived(ctx, srcDir, func(fullpath, name string, info os.FileInfo) error {
+    target := ""
+    if fsutil.IsSymlink(info.Mode()) {
+      var err error
+      if target, err = os.Readlink(fullpath); err != nil {
+        return err
+      }
+    }
+
+    header, err := tar.FileInfoHeader(info, filepath.ToSlash(target))
+    if err != nil {
+      return err
+    }
+
+    header.Name = name
+    if info.IsDir() {
+      header.Name += "/"
+    }
+
+    if err = tw.WriteHeader(header); err != nil {
+      return err
+    }
+
+    if !info.Mode().IsRegular() {
+      return nil
+    }
+
+    return copyFileInto(tw, fullpath)
+  })
+
+  if cerr := tw.Close(); err == nil {
+    err = cerr
+  }
+
+  return err
+}
+
+func copyFileInto(w io.Writer, fullpath string) error {
+  in, err := os.Open(fullpath)
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  _, err = io.Copy(w, in)
+  return err
+}
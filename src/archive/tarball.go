@@ -0,0 +1,129 @@
+package archive
+
+import (
+  "archive/tar"
+  "context"
+  "compress/gzip"
+  "io"
+  "log"
+  "os"
+  "strings"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+func Untar(ctx context.Context, src, dest string, mp *fsutil.MetadataPolicy) error {
+  log.Printf("Extracting %v into %v", src, dest)
+
+  f, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  var r io.Reader = f
+
+  lower := strings.ToLower(src)
+  if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+    gzr, err := gzip.NewReader(f)
+    if err != nil {
+      return err
+    }
+
+    defer gzr.Close()
+    r = gzr
+  }
+
+  tr := tar.NewReader(r)
+  dirs := make([]extractedDir, 0)
+
+  for {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    header, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+
+    if err != nil {
+      return err
+    }
+
+    path, err := fsutil.SafeJoin(dest, header.Name)
+    if err != nil {
+      return err
+    }
+
+    md := &fsutil.FileMetadata{
+      Mode: header.FileInfo().Mode(),
+      ModTime: header.ModTime,
+      Uid: header.Uid,
+      Gid: header.Gid,
+      HasOwner: true,
+    }
+
+    switch header.Typeflag {
+    case tar.TypeDir:
+      err = writeExtractedDir(dest, path)
+      dirs = append(dirs, extractedDir{path, md})
+    case tar.TypeReg:
+      err = writeExtractedFile(dest, path, tr, md, mp)
+    case tar.TypeSymlink:
+      err = writeExtractedSymlink(dest, path, header.Linkname, md, mp)
+    case tar.TypeLink:
+      // hardlinks are extracted as copies of already extracted files
+      var linkpath string
+      linkpath, err = fsutil.SafeJoin(dest, header.Linkname)
+      if err == nil {
+        err = copyExtractedFile(dest, linkpath, path, md, mp)
+      }
+    default:
+      logging.WithField(logging.FieldPath, header.Name).Warnf("Skipping unsupported tar entry")
+    }
+
+    if err != nil {
+      return err
+    }
+  }
+
+  if err = validateExtractedLinks(dest); err != nil {
+    return err
+  }
+
+  return applyDirsMetadata(dirs, mp)
+}
+
+func copyExtractedFile(dest, src, dst string, md *fsutil.FileMetadata, mp *fsutil.MetadataPolicy) error {
+  err := fsutil.CheckNoSymlinkParents(fsutil.OS, dest, src)
+  if err != nil {
+    return err
+  }
+
+  fi, err := os.Lstat(src)
+  if err != nil {
+    return err
+  }
+
+  // hardlink to a symlink is extracted as the same symlink
+  // so the file it points to is never read
+  if fsutil.IsSymlink(fi.Mode()) {
+    target, err := os.Readlink(src)
+    if err != nil {
+      return err
+    }
+
+    return writeExtractedSymlink(dest, dst, target, md, mp)
+  }
+
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  return writeExtractedFile(dest, dst, in, md, mp)
+}
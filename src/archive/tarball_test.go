@@ -0,0 +1,139 @@
+package archive
+
+import (
+  "archive/tar"
+  "context"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "runtime"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+func writeTar(t *testing.T, tarPath string, headers []*tar.Header) {
+  f, err := os.Create(tarPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  defer f.Close()
+
+  tw := tar.NewWriter(f)
+  for _, header := range headers {
+    if header.Typeflag == tar.TypeReg {
+      header.Size = int64(len(header.Name))
+    }
+
+    if err := tw.WriteHeader(header); err != nil {
+      t.Fatal(err)
+    }
+
+    if header.Typeflag == tar.TypeReg {
+      tw.Write([]byte(header.Name))
+    }
+  }
+
+  if err := tw.Close(); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func skipWithoutSymlinks(t *testing.T) {
+  // creating symlinks needs admin rights or developer mode on Windows
+  if runtime.GOOS == "windows" {
+    t.Skip("symlinks are not always available on Windows")
+  }
+}
+
+func TestUntarSymlinkChainEscape(t *testing.T) {
+  skipWithoutSymlinks(t)
+
+  tests := []struct {
+    name string
+    headers []*tar.Header
+  }{
+    {"parent link chain", []*tar.Header{
+      {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+      {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/..", Mode: 0777},
+      {Name: "b/evil", Typeflag: tar.TypeReg, Mode: 0644},
+    }},
+    {"parent link dir", []*tar.Header{
+      {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+      {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/..", Mode: 0777},
+      {Name: "b/evil/", Typeflag: tar.TypeDir, Mode: 0755},
+    }},
+    {"parent link chain only", []*tar.Header{
+      {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+      {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/..", Mode: 0777},
+    }},
+    {"parent link chain reversed", []*tar.Header{
+      {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/..", Mode: 0777},
+      {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+    }},
+    {"hardlink through link", []*tar.Header{
+      {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+      {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/..", Mode: 0777},
+      {Name: "c", Typeflag: tar.TypeLink, Linkname: "b/secret", Mode: 0644},
+    }},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      root, err := ioutil.TempDir("", "untar")
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      defer os.RemoveAll(root)
+
+      dest := filepath.Join(root, "dest")
+      ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644)
+
+      tarPath := filepath.Join(root, "package.tar")
+      writeTar(t, tarPath, tt.headers)
+
+      err = Untar(context.Background(), tarPath, dest, &fsutil.MetadataPolicy{})
+      if err == nil {
+        t.Fatal("extraction through symlink chain succeeded")
+      }
+
+      if _, err := os.Lstat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+        t.Fatal("file was written outside of the destination")
+      }
+    })
+  }
+}
+
+func TestUntarReplacesSymlink(t *testing.T) {
+  skipWithoutSymlinks(t)
+
+  root, err := ioutil.TempDir("", "untar")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  defer os.RemoveAll(root)
+
+  dest := filepath.Join(root, "dest")
+  tarPath := filepath.Join(root, "package.tar")
+  writeTar(t, tarPath, []*tar.Header{
+    {Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+    {Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a/evil", Mode: 0777},
+    {Name: "c", Typeflag: tar.TypeReg, Mode: 0644},
+  })
+
+  err = Untar(context.Background(), tarPath, dest, &fsutil.MetadataPolicy{})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if _, err := os.Lstat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+    t.Fatal("file was written outside of the destination")
+  }
+
+  fi, err := os.Lstat(filepath.Join(dest, "c"))
+  if err != nil || !fi.Mode().IsRegular() {
+    t.Fatalf("symlink was not replaced with the file: %v", err)
+  }
+}
@@ -0,0 +1,94 @@
+package archive
+
+import (
+  "archive/zip"
+  "context"
+  "log"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+func Unzip(ctx context.Context, src, dest string, mp *fsutil.MetadataPolicy) error {
+  log.Printf("Extracting %v into %v", src, dest)
+  
+  r, err := zip.OpenReader(src)
+  if err != nil {
+    return err
+  }
+
+  defer func() {
+    if err := r.Close(); err != nil {
+      panic(err)
+    }
+  }()
+
+  dirs := make([]extractedDir, 0)
+
+  extractAndWriteFile := func(f *zip.File) error {
+    rc, err := f.Open()
+    if err != nil {
+      return err
+    }
+    
+    defer func() {
+      if err := rc.Close(); err != nil {
+        panic(err)
+      }
+    }()
+
+    path, err := fsutil.SafeJoin(dest, f.Name)
+    if err != nil {
+      return err
+    }
+
+    md := zipFileMetadata(f)
+
+    if f.FileInfo().IsDir() {
+      err = writeExtractedDir(dest, path)
+      if err != nil {
+        return err
+      }
+
+      // directory metadata is applied after all files are written
+      dirs = append(dirs, extractedDir{path, md})
+    } else if fsutil.IsSymlink(f.Mode()) {
+      target, err := fsutil.ReadSymlinkTarget(rc)
+      if err != nil {
+        return err
+      }
+
+      return writeExtractedSymlink(dest, path, target, md, mp)
+    } else {
+      return writeExtractedFile(dest, path, rc, md, mp)
+    }
+    
+    return nil
+  }
+
+  for _, f := range r.File {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    err := extractAndWriteFile(f)
+    if err != nil {
+      return err
+    }
+  }
+
+  if err = validateExtractedLinks(dest); err != nil {
+    return err
+  }
+
+  return applyDirsMetadata(dirs, mp)
+}
+
+func zipFileMetadata(f *zip.File) *fsutil.FileMetadata {
+  md := &fsutil.FileMetadata{
+    Mode: f.Mode(),
+    ModTime: f.Modified,
+  }
+
+  md.Uid, md.Gid, md.HasOwner = fsutil.ParseUnixOwner(f.Extra)
+
+  return md
+}
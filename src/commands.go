@@ -0,0 +1,361 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "github.com/ribtoks/ministaller/src/archive"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/hashing"
+  "github.com/ribtoks/ministaller/src/logging"
+  "github.com/ribtoks/ministaller/src/ministaller"
+)
+
+// packageDiff is the output of diff command
+type packageDiff struct {
+  Add []*ministaller.UpdateFileInfo `json:"add"`
+  Update []*ministaller.UpdateFileInfo `json:"update"`
+  Remove []*ministaller.UpdateFileInfo `json:"remove"`
+  Move []*ministaller.MoveFileInfo `json:"move"`
+  DirsToAdd []*ministaller.UpdateFileInfo `json:"dirs-add"`
+  DirsToRemove []*ministaller.UpdateFileInfo `json:"dirs-remove"`
+}
+
+func (pd *packageDiff) changesCount() int {
+  return len(pd.Add) + len(pd.Update) + len(pd.Remove) + len(pd.Move) + len(pd.DirsToAdd) + len(pd.DirsToRemove)
+}
+
+func validateDownload() error {
+  if len(urlFlag) == 0 { return errors.New("url is required") }
+  if len(hashFlag) == 0 { return errors.New("hash is required") }
+
+  return nil
+}
+
+func validateBuild() error {
+  sourceFileInfo, err := os.Stat(sourceDirFlag)
+  if err != nil { return err }
+  if !sourceFileInfo.IsDir() { return errors.New("source-dir does not point to a directory") }
+  if len(outputFlag) == 0 { return errors.New("output is required") }
+
+  return nil
+}
+
+// generateDiff prepares the package and compares it with the install dir
+func generateDiff(ctx context.Context) (*packageDiff, error) {
+  metadataPolicy := fsutil.NewMetadataPolicy(preserveOwnerFlag, applyUmaskFlag)
+
+  pp, err := preparePackage(ctx, metadataPolicy)
+  defer pp.remove()
+  if err != nil {
+    return nil, err
+  }
+
+  df := ministaller.NewDiffGenerator(ministaller.DiffOptions{
+    InstallDir: filepath.ToSlash(installPathFlag),
+    PackageDir: pp.dir,
+    KeepMissing: keepMissingFlag,
+    ForceUpdate: forceUpdateFlag,
+    Concurrency: concurrencyFlag,
+    Metadata: metadataPolicy,
+  })
+
+  if err = df.GenerateDiffs(ctx); err != nil {
+    return nil, err
+  }
+
+  return &packageDiff{
+    Add: df.FilesToAdd(),
+    Update: df.FilesToUpdate(),
+    Remove: df.FilesToRemove(),
+    Move: df.FilesToMove(),
+    DirsToAdd: df.DirsToAdd(),
+    DirsToRemove: df.DirsToRemove(),
+  }, nil
+}
+
+// commandExitCode logs the failure of the command and converts it to exit code
+func commandExitCode(ctx context.Context, name string, err error) int {
+  if ctx.Err() != nil {
+    log.Printf("%v cancelled", name)
+    return exitCodeCancelled
+  }
+
+  logging.WithError(err).Errorf("%v failed", name)
+  fmt.Fprintln(os.Stderr, err)
+  return exitCodeFailure
+}
+
+func runCheck(ctx context.Context, cancel context.CancelFunc) int {
+  pd, err := generateDiff(ctx)
+  if err != nil {
+    return commandExitCode(ctx, "Check", err)
+  }
+
+  count := pd.changesCount()
+  log.Printf("Found %v changes", count)
+
+  if count == 0 {
+    fmt.Println("Up to date")
+    return exitCodeSuccess
+  }
+
+  fmt.Printf("Update available: %v to add, %v to update, %v to remove, %v to move\n",
+    len(pd.Add), len(pd.Update), len(pd.Remove), len(pd.Move))
+  return exitCodeUpdateAvailable
+}
+
+func runDiff(ctx context.Context, cancel context.CancelFunc) int {
+  pd, err := generateDiff(ctx)
+  if err != nil {
+    return commandExitCode(ctx, "Diff", err)
+  }
+
+  var w io.Writer = os.Stdout
+  if len(outputFlag) > 0 {
+    f, err := os.Create(outputFlag)
+    if err != nil {
+      return commandExitCode(ctx, "Diff", err)
+    }
+
+    defer f.Close()
+    w = f
+  }
+
+  encoder := json.NewEncoder(w)
+  encoder.SetIndent("", "  ")
+  if err = encoder.Encode(pd); err != nil {
+    return commandExitCode(ctx, "Diff", err)
+  }
+
+  return exitCodeSuccess
+}
+
+func runDownload(ctx context.Context, cancel context.CancelFunc) int {
+  cache := ministaller.NewPackageCache(stateDirFlag)
+
+  if len(outputFlag) == 0 {
+    if cachedPath, ok := cache.Lookup(hashFlag); ok {
+      log.Printf("Package is downloaded already to %v", cachedPath)
+      fmt.Println(cachedPath)
+      return exitCodeSuccess
+    }
+  }
+
+  localPath, err := downloadFile(ctx, urlFlag, downloadRetryCount)
+  if err != nil {
+    return commandExitCode(ctx, "Download", err)
+  }
+
+  defer os.Remove(localPath)
+
+  hash, err := hashing.CalculateFileHash(localPath)
+  if err != nil {
+    return commandExitCode(ctx, "Download", err)
+  }
+
+  if hash != hashFlag {
+    return commandExitCode(ctx, "Download", fmt.Errorf("hash mismatch: %v expected but %v found", hashFlag, hash))
+  }
+
+  output := outputFlag
+  if len(output) > 0 {
+    err = moveFile(localPath, output)
+  } else {
+    output, err = cache.Store(localPath, hashFlag, archiveExt(urlFlag))
+    collectGarbage(cache, hashFlag)
+  }
+
+  if err != nil {
+    return commandExitCode(ctx, "Download", err)
+  }
+
+  log.Printf("Saved package to %v", output)
+  fmt.Println(output)
+  return exitCodeSuccess
+}
+
+// collectGarbage removes old downloaded packages except pinned ones
+func collectGarbage(cache *ministaller.PackageCache, pinned ...string) {
+  if err := cache.GC(cacheKeepFlag, cacheMaxAgeFlag, pinned...); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: cache.Dir(), logging.FieldError: err}).Warnf("Failed to remove old downloaded packages")
+  }
+}
+
+func validateApply() error {
+  if err := validateInstallPath(); err != nil {
+    return err
+  }
+
+  if len(hashFlag) == 0 { return errors.New("hash is required") }
+  if len(stateDirFlag) == 0 { return errors.New("state-dir is required") }
+
+  return nil
+}
+
+// runApply installs the package saved by download command, it never
+// goes to the network so it can run e.g. when the application exits
+func runApply(ctx context.Context, cancel context.CancelFunc) int {
+  cache := ministaller.NewPackageCache(stateDirFlag)
+
+  cachedPath, ok := cache.Lookup(hashFlag)
+  if !ok {
+    return commandExitCode(ctx, "Apply", fmt.Errorf("package %v was not downloaded", hashFlag))
+  }
+
+  packagePathFlag, urlFlag = cachedPath, ""
+  exitCode := runInstall(ctx, cancel)
+
+  if exitCode == exitCodeSuccess {
+    collectGarbage(cache)
+  }
+
+  return exitCode
+}
+
+// downloadFileName returns the last element of the url path
+func downloadFileName(remoteAddr string) string {
+  name := ""
+  if u, err := url.Parse(remoteAddr); err == nil {
+    name = path.Base(u.Path)
+  }
+
+  if len(name) == 0 || name == "/" || name == "." {
+    name = appName + ".zip"
+  }
+
+  return name
+}
+
+// archiveExt returns extension of the package archive
+func archiveExt(location string) string {
+  name := strings.ToLower(downloadFileName(location))
+
+  for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+    if strings.HasSuffix(name, ext) {
+      return ext
+    }
+  }
+
+  return ".zip"
+}
+
+// moveFile renames the file falling back to copy when
+// temp dir is on another volume
+func moveFile(src, dest string) error {
+  if err := os.Rename(src, dest); err == nil {
+    return nil
+  }
+
+  if err := copyFile(src, dest); err != nil {
+    return err
+  }
+
+  return os.Remove(src)
+}
+
+func copyFile(src, dest string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  out, err := os.Create(dest)
+  if err != nil {
+    return err
+  }
+
+  if _, err = io.Copy(out, in); err != nil {
+    out.Close()
+    os.Remove(dest)
+    return err
+  }
+
+  return out.Close()
+}
+
+func runVerify(ctx context.Context, cancel context.CancelFunc) int {
+  metadataPolicy := fsutil.NewMetadataPolicy(preserveOwnerFlag, applyUmaskFlag)
+
+  if len(urlFlag) == 0 && len(hashFlag) > 0 {
+    hash, err := hashing.CalculateFileHash(packagePathFlag)
+    if err != nil {
+      return commandExitCode(ctx, "Verify", err)
+    }
+
+    if hash != hashFlag {
+      return commandExitCode(ctx, "Verify", fmt.Errorf("hash mismatch: %v expected but %v found", hashFlag, hash))
+    }
+  }
+
+  pp, err := preparePackage(ctx, metadataPolicy)
+  defer pp.remove()
+  if err != nil {
+    return commandExitCode(ctx, "Verify", err)
+  }
+
+  if len(urlFlag) > 0 && pp.archivePath == packagePathFlag {
+    return commandExitCode(ctx, "Verify", errors.New("downloaded package is corrupted"))
+  }
+
+  hashes, err := hashing.CalculateHashes(ctx, fsutil.OS, pp.dir, fsutil.NewWorkerPool(fsutil.DefaultConcurrency(pp.dir)))
+  if err != nil {
+    return commandExitCode(ctx, "Verify", err)
+  }
+
+  log.Printf("Package is valid")
+  fmt.Printf("Package is valid: %v entries, version %v\n", len(hashes), pp.manifest.Version)
+  return exitCodeSuccess
+}
+
+func runRollback(ctx context.Context, cancel context.CancelFunc) int {
+  installLock, err := ministaller.AcquireInstallLock(installPathFlag, lockWaitFlag)
+  if err == ministaller.ErrInstallLocked {
+    log.Println(err)
+    return exitCodeLocked
+  } else if err != nil {
+    return commandExitCode(ctx, "Rollback", err)
+  }
+
+  defer installLock.Release()
+
+  rolledBack, err := ministaller.RollbackInterruptedInstall(fsutil.OS, filepath.ToSlash(installPathFlag))
+  if err != nil {
+    commandExitCode(ctx, "Rollback", err)
+    return recoveryExitCode(err)
+  }
+
+  if rolledBack {
+    fmt.Println("Interrupted install was rolled back")
+  } else {
+    fmt.Println("Nothing to roll back")
+  }
+
+  return exitCodeSuccess
+}
+
+func runBuild(ctx context.Context, cancel context.CancelFunc) int {
+  err := archive.Create(ctx, sourceDirFlag, outputFlag)
+  if err != nil {
+    return commandExitCode(ctx, "Build", err)
+  }
+
+  hash, err := hashing.CalculateFileHash(outputFlag)
+  if err != nil {
+    return commandExitCode(ctx, "Build", err)
+  }
+
+  log.Printf("Built %v with hash %v", outputFlag, hash)
+  fmt.Println(hash)
+  return exitCodeSuccess
+}
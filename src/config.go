@@ -0,0 +1,154 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "github.com/BurntSushi/toml"
+)
+
+const (
+  envPrefix = "MINISTALLER_"
+  configEnv = envPrefix + "CONFIG"
+)
+
+var (
+  // looked up next to the installer if -config is not passed
+  defaultConfigNames = []string{"ministaller.config.toml", "ministaller.config.json"}
+)
+
+// Config holds options from the config file keyed by flag name.
+// Tables named after commands override top level options for that command
+type Config map[string]interface{}
+
+// loadConfig reads JSON or TOML config depending on the extension
+func loadConfig(configPath string) (Config, error) {
+  data, err := ioutil.ReadFile(configPath)
+  if err != nil {
+    return nil, err
+  }
+
+  config := make(Config)
+
+  if strings.HasSuffix(strings.ToLower(configPath), ".toml") {
+    err = toml.Unmarshal(data, &config)
+  } else {
+    err = json.Unmarshal(data, &config)
+  }
+
+  if err != nil {
+    return nil, fmt.Errorf("failed to parse config %v: %v", configPath, err)
+  }
+
+  return config, nil
+}
+
+// findConfig returns config path passed explicitly or found next to the installer
+func findConfig(explicitPath, exePath string) string {
+  if len(explicitPath) > 0 {
+    return explicitPath
+  }
+
+  if envPath := os.Getenv(configEnv); len(envPath) > 0 {
+    return envPath
+  }
+
+  for _, name := range defaultConfigNames {
+    candidate := filepath.Join(filepath.Dir(exePath), name)
+    if _, err := os.Stat(candidate); err == nil {
+      return candidate
+    }
+  }
+
+  return ""
+}
+
+// commandOptions merges top level options with the ones of the command
+func (c Config) commandOptions(command string) map[string]interface{} {
+  options := make(map[string]interface{})
+
+  for key, value := range c {
+    if _, isTable := value.(map[string]interface{}); !isTable {
+      options[key] = value
+    }
+  }
+
+  if table, ok := c[command].(map[string]interface{}); ok {
+    for key, value := range table {
+      options[key] = value
+    }
+  }
+
+  return options
+}
+
+// envName returns environment variable for the flag, e.g. MINISTALLER_INSTALL_PATH
+func envName(flagName string) string {
+  return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyDefaults sets flags which were not passed explicitly from
+// environment variables and then from the config.
+// Precedence is flags > environment > config > defaults
+func applyDefaults(fs *flag.FlagSet, command string, config Config) error {
+  passed := make(map[string]bool)
+  fs.Visit(func(f *flag.Flag) {
+    passed[f.Name] = true
+  })
+
+  options := config.commandOptions(command)
+
+  var err error
+  fs.VisitAll(func(f *flag.Flag) {
+    if err != nil || passed[f.Name] {
+      return
+    }
+
+    if value, ok := os.LookupEnv(envName(f.Name)); ok {
+      if serr := fs.Set(f.Name, value); serr != nil {
+        err = fmt.Errorf("invalid %v: %v", envName(f.Name), serr)
+      }
+
+      return
+    }
+
+    if value, ok := options[f.Name]; ok {
+      if serr := setFromConfig(fs, f.Name, value); serr != nil {
+        err = fmt.Errorf("invalid %v in config: %v", f.Name, serr)
+      }
+    }
+  })
+
+  return err
+}
+
+// setFromConfig sets the flag from the config value, lists set repeated flags
+func setFromConfig(fs *flag.FlagSet, name string, value interface{}) error {
+  if values, ok := value.([]interface{}); ok {
+    for _, v := range values {
+      if err := setFromConfig(fs, name, v); err != nil {
+        return err
+      }
+    }
+
+    return nil
+  }
+
+  switch v := value.(type) {
+  case string:
+    return fs.Set(name, v)
+  case bool:
+    return fs.Set(name, strconv.FormatBool(v))
+  case float64:
+    return fs.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+  case int64:
+    return fs.Set(name, strconv.FormatInt(v, 10))
+  }
+
+  return fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+  "flag"
+  "io/ioutil"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+type testOptions struct {
+  installPath string
+  concurrency int
+  force bool
+  exclude []string
+}
+
+func TestApplyDefaults(t *testing.T) {
+  tests := []struct {
+    name string
+    // name of the config file and its contents, no config if empty
+    configName string
+    config string
+    env map[string]string
+    args []string
+    command string
+    want testOptions
+    wantErr bool
+  }{
+    {name: "defaults", command: "install",
+      want: testOptions{installPath: "default", concurrency: 1}},
+    {name: "json", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"install-path": "json", "concurrency": 4, "force": true, "exclude": ["a", "b"]}`,
+      want: testOptions{installPath: "json", concurrency: 4, force: true, exclude: []string{"a", "b"}}},
+    {name: "toml", command: "install",
+      configName: "ministaller.config.toml",
+      config: "install-path = \"toml\"\nconcurrency = 8\nforce = true\nexclude = [\"a\", \"b\"]\n",
+      want: testOptions{installPath: "toml", concurrency: 8, force: true, exclude: []string{"a", "b"}}},
+    {name: "json command table", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"install-path": "top", "concurrency": 2, "install": {"install-path": "install", "exclude": ["a"]}}`,
+      want: testOptions{installPath: "install", concurrency: 2, exclude: []string{"a"}}},
+    {name: "json other command table", command: "diff",
+      configName: "ministaller.config.json",
+      config: `{"install-path": "top", "install": {"install-path": "install"}}`,
+      want: testOptions{installPath: "top", concurrency: 1}},
+    {name: "toml command table", command: "install",
+      configName: "ministaller.config.toml",
+      config: "install-path = \"top\"\n\n[install]\nconcurrency = 2\nexclude = [\"a\"]\n",
+      want: testOptions{installPath: "top", concurrency: 2, exclude: []string{"a"}}},
+    {name: "env over config", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"install-path": "json", "concurrency": 4}`,
+      env: map[string]string{"MINISTALLER_INSTALL_PATH": "env", "MINISTALLER_FORCE": "true"},
+      want: testOptions{installPath: "env", concurrency: 4, force: true}},
+    {name: "env over command table", command: "install",
+      configName: "ministaller.config.toml",
+      config: "[install]\nconcurrency = 2\n",
+      env: map[string]string{"MINISTALLER_CONCURRENCY": "3"},
+      want: testOptions{installPath: "default", concurrency: 3}},
+    {name: "flags over env and config", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"install-path": "json", "concurrency": 4, "install": {"force": true}}`,
+      env: map[string]string{"MINISTALLER_INSTALL_PATH": "env"},
+      args: []string{"-install-path", "flag", "-force=false"},
+      want: testOptions{installPath: "flag", concurrency: 4}},
+    {name: "env list", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"exclude": ["a", "b"]}`,
+      env: map[string]string{"MINISTALLER_EXCLUDE": "env"},
+      want: testOptions{installPath: "default", concurrency: 1, exclude: []string{"env"}}},
+    {name: "flag list over config list", command: "install",
+      configName: "ministaller.config.toml",
+      config: "exclude = [\"a\", \"b\"]\n",
+      args: []string{"-exclude", "c", "-exclude", "d"},
+      want: testOptions{installPath: "default", concurrency: 1, exclude: []string{"c", "d"}}},
+    {name: "invalid env", command: "install",
+      env: map[string]string{"MINISTALLER_CONCURRENCY": "many"},
+      wantErr: true},
+    {name: "invalid config value", command: "install",
+      configName: "ministaller.config.json",
+      config: `{"force": "maybe"}`,
+      wantErr: true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      for key, value := range tt.env {
+        t.Setenv(key, value)
+      }
+
+      config := make(Config)
+      if len(tt.configName) > 0 {
+        configPath := filepath.Join(t.TempDir(), tt.configName)
+        if err := ioutil.WriteFile(configPath, []byte(tt.config), 0644); err != nil {
+          t.Fatal(err)
+        }
+
+        var err error
+        if config, err = loadConfig(configPath); err != nil {
+          t.Fatal(err)
+        }
+      }
+
+      var got testOptions
+      var exclude stringsFlag
+      fs := flag.NewFlagSet(tt.command, flag.ContinueOnError)
+      fs.StringVar(&got.installPath, "install-path", "default", "")
+      fs.IntVar(&got.concurrency, "concurrency", 1, "")
+      fs.BoolVar(&got.force, "force", false, "")
+      fs.Var(&exclude, "exclude", "")
+
+      if err := fs.Parse(tt.args); err != nil {
+        t.Fatal(err)
+      }
+
+      err := applyDefaults(fs, tt.command, config)
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("unexpected error: %v", err)
+      }
+
+      if tt.wantErr {
+        return
+      }
+
+      got.exclude = exclude
+      if !reflect.DeepEqual(got, tt.want) {
+        t.Fatalf("got %+v, expected %+v", got, tt.want)
+      }
+    })
+  }
+}
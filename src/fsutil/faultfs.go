@@ -0,0 +1,279 @@
+package fsutil
+
+import (
+  "errors"
+  "os"
+  "path"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+// operations of FS which faults can be injected into
+const (
+  OpOpen = "open"
+  OpStat = "stat"
+  OpReadDir = "readdir"
+  OpMkdir = "mkdir"
+  OpRemove = "remove"
+  OpRename = "rename"
+  OpSymlink = "symlink"
+  OpReadlink = "readlink"
+  OpChmod = "chmod"
+  OpChtimes = "chtimes"
+  OpChown = "chown"
+  OpRead = "read"
+  OpWrite = "write"
+)
+
+var (
+  ErrInjectedFault = errors.New("injected fault")
+)
+
+// FaultRule describes when FaultFS fails an operation
+type FaultRule struct {
+  // operation to fail, any if empty
+  Op string
+  // pattern for path.Match against slash-separated full path
+  // or its base name, any path if empty
+  Path string
+  // number of matching operations which succeed before the fault
+  After int
+  // how many times the fault happens, forever if 0
+  Times int
+  // returned error, ErrInjectedFault if nil
+  Err error
+}
+
+type faultState struct {
+  rule FaultRule
+  matched int
+  failed int
+}
+
+// FaultFS wraps FS and fails operations according to the rules,
+// e.g. to simulate full disk, missing permissions or failing rename
+type FaultFS struct {
+  FS
+  mutex sync.Mutex
+  faults []*faultState
+}
+
+// faultFile injects faults into reads and writes of the open file
+type faultFile struct {
+  File
+  fs *FaultFS
+}
+
+func NewFaultFS(fsys FS, rules ...FaultRule) *FaultFS {
+  ffs := &FaultFS{FS: fsys}
+  for _, rule := range rules {
+    ffs.AddRule(rule)
+  }
+
+  return ffs
+}
+
+func (f *FaultFS) AddRule(rule FaultRule) {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  f.faults = append(f.faults, &faultState{rule: rule})
+}
+
+// Injected returns how many faults were injected so far
+func (f *FaultFS) Injected() int {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  count := 0
+  for _, fault := range f.faults {
+    count += fault.failed
+  }
+
+  return count
+}
+
+func (fs *faultState) matches(op, name string) bool {
+  if len(fs.rule.Op) > 0 && fs.rule.Op != op {
+    return false
+  }
+
+  if len(fs.rule.Path) == 0 {
+    return true
+  }
+
+  name = filepath.ToSlash(name)
+  if ok, _ := path.Match(fs.rule.Path, name); ok {
+    return true
+  }
+
+  ok, _ := path.Match(fs.rule.Path, path.Base(name))
+  return ok
+}
+
+func (f *FaultFS) check(op, name string) error {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  for _, fault := range f.faults {
+    if !fault.matches(op, name) {
+      continue
+    }
+
+    fault.matched++
+    if fault.matched <= fault.rule.After {
+      continue
+    }
+
+    if fault.rule.Times > 0 && fault.failed >= fault.rule.Times {
+      continue
+    }
+
+    fault.failed++
+
+    err := fault.rule.Err
+    if err == nil {
+      err = ErrInjectedFault
+    }
+
+    return &os.PathError{Op: op, Path: name, Err: err}
+  }
+
+  return nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+  return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+  if err := f.check(OpOpen, name); err != nil {
+    return nil, err
+  }
+
+  file, err := f.FS.OpenFile(name, flag, perm)
+  if err != nil {
+    return nil, err
+  }
+
+  return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+  if err := f.check(OpStat, name); err != nil {
+    return nil, err
+  }
+
+  return f.FS.Stat(name)
+}
+
+func (f *FaultFS) Lstat(name string) (os.FileInfo, error) {
+  if err := f.check(OpStat, name); err != nil {
+    return nil, err
+  }
+
+  return f.FS.Lstat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.FileInfo, error) {
+  if err := f.check(OpReadDir, name); err != nil {
+    return nil, err
+  }
+
+  return f.FS.ReadDir(name)
+}
+
+func (f *FaultFS) MkdirAll(name string, perm os.FileMode) error {
+  if err := f.check(OpMkdir, name); err != nil {
+    return err
+  }
+
+  return f.FS.MkdirAll(name, perm)
+}
+
+func (f *FaultFS) Remove(name string) error {
+  if err := f.check(OpRemove, name); err != nil {
+    return err
+  }
+
+  return f.FS.Remove(name)
+}
+
+// Rename is matched by both old and new names
+func (f *FaultFS) Rename(oldname, newname string) error {
+  if err := f.check(OpRename, oldname); err != nil {
+    return err
+  }
+
+  if err := f.check(OpRename, newname); err != nil {
+    return err
+  }
+
+  return f.FS.Rename(oldname, newname)
+}
+
+// CheckRename fails the same way Rename of name would
+func (f *FaultFS) CheckRename(name string) error {
+  if err := f.check(OpRename, name); err != nil {
+    return err
+  }
+
+  return CheckRename(f.FS, name)
+}
+
+func (f *FaultFS) Symlink(target, name string) error {
+  if err := f.check(OpSymlink, name); err != nil {
+    return err
+  }
+
+  return f.FS.Symlink(target, name)
+}
+
+func (f *FaultFS) Readlink(name string) (string, error) {
+  if err := f.check(OpReadlink, name); err != nil {
+    return "", err
+  }
+
+  return f.FS.Readlink(name)
+}
+
+func (f *FaultFS) Chmod(name string, mode os.FileMode) error {
+  if err := f.check(OpChmod, name); err != nil {
+    return err
+  }
+
+  return f.FS.Chmod(name, mode)
+}
+
+func (f *FaultFS) Chtimes(name string, atime, mtime time.Time) error {
+  if err := f.check(OpChtimes, name); err != nil {
+    return err
+  }
+
+  return f.FS.Chtimes(name, atime, mtime)
+}
+
+func (f *FaultFS) Lchown(name string, uid, gid int) error {
+  if err := f.check(OpChown, name); err != nil {
+    return err
+  }
+
+  return f.FS.Lchown(name, uid, gid)
+}
+
+func (ff *faultFile) Read(p []byte) (int, error) {
+  if err := ff.fs.check(OpRead, ff.Name()); err != nil {
+    return 0, err
+  }
+
+  return ff.File.Read(p)
+}
+
+func (ff *faultFile) Write(p []byte) (int, error) {
+  if err := ff.fs.check(OpWrite, ff.Name()); err != nil {
+    return 0, err
+  }
+
+  return ff.File.Write(p)
+}
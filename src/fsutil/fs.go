@@ -0,0 +1,176 @@
+package fsutil
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "time"
+)
+
+// FS is the file system used by the installer and the diff generator.
+// Paths are slash-separated like everywhere in the installer
+type FS interface {
+  Open(name string) (File, error)
+  OpenFile(name string, flag int, perm os.FileMode) (File, error)
+  Stat(name string) (os.FileInfo, error)
+  Lstat(name string) (os.FileInfo, error)
+  // ReadDir returns entries of the directory sorted by name
+  ReadDir(name string) ([]os.FileInfo, error)
+  MkdirAll(name string, perm os.FileMode) error
+  Remove(name string) error
+  Rename(oldname, newname string) error
+  Symlink(target, name string) error
+  Readlink(name string) (string, error)
+  Chmod(name string, mode os.FileMode) error
+  Chtimes(name string, atime, mtime time.Time) error
+  Lchown(name string, uid, gid int) error
+}
+
+// RenameChecker is implemented by file systems which can tell
+// whether a file could be renamed without renaming it
+type RenameChecker interface {
+  CheckRename(name string) error
+}
+
+// CheckRename checks that name can be renamed right now and changes nothing.
+// File systems without RenameChecker only check that name exists
+func CheckRename(fsys FS, name string) error {
+  if checker, ok := fsys.(RenameChecker); ok {
+    return checker.CheckRename(name)
+  }
+
+  _, err := fsys.Lstat(name)
+  return err
+}
+
+// File is an open file of FS
+type File interface {
+  io.Reader
+  io.Writer
+  io.Closer
+  Name() string
+  Sync() error
+}
+
+// OSFS is FS backed by the real file system
+type OSFS struct {
+}
+
+var (
+  // OS is the default file system
+  OS FS = OSFS{}
+)
+
+func (OSFS) Open(name string) (File, error) {
+  return os.Open(name)
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+  return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+  return os.Stat(name)
+}
+
+func (OSFS) Lstat(name string) (os.FileInfo, error) {
+  return os.Lstat(name)
+}
+
+func (OSFS) ReadDir(name string) ([]os.FileInfo, error) {
+  return ioutil.ReadDir(name)
+}
+
+func (OSFS) MkdirAll(name string, perm os.FileMode) error {
+  return os.MkdirAll(name, perm)
+}
+
+func (OSFS) Remove(name string) error {
+  return os.Remove(name)
+}
+
+func (OSFS) Rename(oldname, newname string) error {
+  return os.Rename(oldname, newname)
+}
+
+func (OSFS) Symlink(target, name string) error {
+  return os.Symlink(filepath.FromSlash(target), name)
+}
+
+func (OSFS) Readlink(name string) (string, error) {
+  return os.Readlink(name)
+}
+
+func (OSFS) Chmod(name string, mode os.FileMode) error {
+  return os.Chmod(name, mode)
+}
+
+func (OSFS) Chtimes(name string, atime, mtime time.Time) error {
+  return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFS) Lchown(name string, uid, gid int) error {
+  return os.Lchown(name, uid, gid)
+}
+
+func (OSFS) CheckRename(name string) error {
+  return CheckRenamable(name)
+}
+
+// Walk is filepath.Walk over fsys: symlinks are reported but not followed
+func Walk(fsys FS, root string, walkFn filepath.WalkFunc) error {
+  info, err := fsys.Lstat(root)
+  if err != nil {
+    err = walkFn(root, nil, err)
+  } else {
+    err = walk(fsys, root, info, walkFn)
+  }
+
+  if err == filepath.SkipDir {
+    return nil
+  }
+
+  return err
+}
+
+func walk(fsys FS, fullpath string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+  if !info.IsDir() {
+    return walkFn(fullpath, info, nil)
+  }
+
+  entries, err := fsys.ReadDir(fullpath)
+  err1 := walkFn(fullpath, info, err)
+  if err != nil || err1 != nil {
+    return err1
+  }
+
+  for _, entry := range entries {
+    err = walk(fsys, filepath.Join(fullpath, entry.Name()), entry, walkFn)
+    if err != nil {
+      if !entry.IsDir() || err != filepath.SkipDir {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// ReadFile reads the whole file from fsys
+func ReadFile(fsys FS, name string) ([]byte, error) {
+  f, err := fsys.Open(name)
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+  return ioutil.ReadAll(f)
+}
+
+func sortByName(entries []os.FileInfo) {
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].Name() < entries[j].Name()
+  })
+}
@@ -0,0 +1,15 @@
+package fsutil
+
+import (
+  "io/ioutil"
+  "log"
+  "os"
+  "testing"
+)
+
+func TestMain(m *testing.M) {
+  // only test failures are printed
+  log.SetOutput(ioutil.Discard)
+
+  os.Exit(m.Run())
+}
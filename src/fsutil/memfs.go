@@ -0,0 +1,498 @@
+package fsutil
+
+import (
+  "bytes"
+  "errors"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // max number of symlinks followed when resolving a path
+  maxSymlinkDepth = 40
+)
+
+// MemFS is in-memory FS for simulating installs without touching the disk.
+// It is safe for concurrent use
+type MemFS struct {
+  mutex sync.Mutex
+  nodes map[string]*memNode
+}
+
+type memNode struct {
+  mode os.FileMode
+  modTime time.Time
+  data []byte
+  target string
+  uid int
+  gid int
+}
+
+type memFileInfo struct {
+  name string
+  node memNode
+}
+
+// memFile keeps contents while open, they are stored on Close
+type memFile struct {
+  fs *MemFS
+  name string
+  reader *bytes.Reader
+  buffer *bytes.Buffer
+  writable bool
+  closed bool
+}
+
+func NewMemFS() *MemFS {
+  return &MemFS{
+    nodes: map[string]*memNode{
+      "/": &memNode{mode: os.ModeDir | DefaultDirMode, modTime: time.Now()},
+    },
+  }
+}
+
+func cleanMemPath(name string) string {
+  return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func memError(op, name string, err error) error {
+  return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve follows symlinks in the path. Last element is followed only if followLast
+func (m *MemFS) resolve(name string, followLast bool) (string, error) {
+  name = cleanMemPath(name)
+
+  for depth := 0; depth < maxSymlinkDepth; depth++ {
+    parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+    current := "/"
+    resolved := true
+
+    for i, part := range parts {
+      if len(part) == 0 {
+        continue
+      }
+
+      next := path.Join(current, part)
+      node, ok := m.nodes[next]
+      last := i == len(parts) - 1
+
+      if ok && IsSymlink(node.mode) && (!last || followLast) {
+        target := node.target
+        if !path.IsAbs(target) {
+          target = path.Join(current, target)
+        }
+
+        name = cleanMemPath(path.Join(append([]string{target}, parts[i+1:]...)...))
+        resolved = false
+        break
+      }
+
+      if !ok && !last {
+        return "", os.ErrNotExist
+      }
+
+      if ok && !last && !node.mode.IsDir() {
+        return "", errors.New("not a directory")
+      }
+
+      current = next
+    }
+
+    if resolved {
+      return name, nil
+    }
+  }
+
+  return "", errors.New("too many levels of symbolic links")
+}
+
+func (m *MemFS) lookup(op, name string, followLast bool) (string, *memNode, error) {
+  resolved, err := m.resolve(name, followLast)
+  if err != nil {
+    return "", nil, memError(op, name, err)
+  }
+
+  node, ok := m.nodes[resolved]
+  if !ok {
+    return "", nil, memError(op, name, os.ErrNotExist)
+  }
+
+  return resolved, node, nil
+}
+
+// parentDir checks that parent of the new entry exists and is a directory
+func (m *MemFS) parentDir(op, name string) (string, error) {
+  resolved, err := m.resolve(name, false)
+  if err != nil {
+    return "", memError(op, name, err)
+  }
+
+  parent, ok := m.nodes[path.Dir(resolved)]
+  if !ok {
+    return "", memError(op, name, os.ErrNotExist)
+  }
+
+  if !parent.mode.IsDir() {
+    return "", memError(op, name, errors.New("not a directory"))
+  }
+
+  return resolved, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+  return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, node, err := m.lookup("open", name, true)
+  if err != nil {
+    if flag & os.O_CREATE == 0 {
+      return nil, err
+    }
+
+    if resolved, err = m.parentDir("open", name); err != nil {
+      return nil, err
+    }
+
+    node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+    m.nodes[resolved] = node
+  } else if flag & (os.O_CREATE | os.O_EXCL) == os.O_CREATE | os.O_EXCL {
+    return nil, memError("open", name, os.ErrExist)
+  }
+
+  if node.mode.IsDir() {
+    return nil, memError("open", name, errors.New("is a directory"))
+  }
+
+  writable := flag & (os.O_WRONLY | os.O_RDWR) != 0
+  f := &memFile{fs: m, name: resolved, writable: writable}
+
+  if writable {
+    f.buffer = &bytes.Buffer{}
+    if flag & os.O_TRUNC == 0 {
+      f.buffer.Write(node.data)
+    }
+  } else {
+    f.reader = bytes.NewReader(node.data)
+  }
+
+  return f, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, node, err := m.lookup("stat", name, true)
+  if err != nil {
+    return nil, err
+  }
+
+  return &memFileInfo{name: path.Base(resolved), node: *node}, nil
+}
+
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, node, err := m.lookup("lstat", name, false)
+  if err != nil {
+    return nil, err
+  }
+
+  return &memFileInfo{name: path.Base(resolved), node: *node}, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, node, err := m.lookup("readdir", name, true)
+  if err != nil {
+    return nil, err
+  }
+
+  if !node.mode.IsDir() {
+    return nil, memError("readdir", name, errors.New("not a directory"))
+  }
+
+  entries := make([]os.FileInfo, 0)
+  for p, child := range m.nodes {
+    if p != resolved && path.Dir(p) == resolved {
+      entries = append(entries, &memFileInfo{name: path.Base(p), node: *child})
+    }
+  }
+
+  sortByName(entries)
+  return entries, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  // every created parent exists before the next one is resolved
+  current := "/"
+  for _, part := range strings.Split(strings.TrimPrefix(cleanMemPath(name), "/"), "/") {
+    if len(part) == 0 {
+      continue
+    }
+
+    resolved, err := m.resolve(path.Join(current, part), true)
+    if err != nil {
+      return memError("mkdir", name, err)
+    }
+
+    node, ok := m.nodes[resolved]
+    if !ok {
+      m.nodes[resolved] = &memNode{mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+    } else if !node.mode.IsDir() {
+      return memError("mkdir", name, errors.New("not a directory"))
+    }
+
+    current = resolved
+  }
+
+  return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, node, err := m.lookup("remove", name, false)
+  if err != nil {
+    return err
+  }
+
+  if node.mode.IsDir() && m.hasChildren(resolved) {
+    return memError("remove", name, errors.New("directory not empty"))
+  }
+
+  delete(m.nodes, resolved)
+  return nil
+}
+
+func (m *MemFS) hasChildren(dir string) bool {
+  for p := range m.nodes {
+    if p != dir && path.Dir(p) == dir {
+      return true
+    }
+  }
+
+  return false
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  oldpath, node, err := m.lookup("rename", oldname, false)
+  if err != nil {
+    return err
+  }
+
+  newpath, err := m.parentDir("rename", newname)
+  if err != nil {
+    return err
+  }
+
+  if existing, ok := m.nodes[newpath]; ok {
+    if existing.mode.IsDir() != node.mode.IsDir() || (existing.mode.IsDir() && m.hasChildren(newpath)) {
+      return memError("rename", newname, os.ErrExist)
+    }
+  }
+
+  if strings.HasPrefix(newpath, oldpath + "/") {
+    return memError("rename", newname, errors.New("invalid argument"))
+  }
+
+  // directories are moved with everything inside
+  for p, child := range m.nodes {
+    if strings.HasPrefix(p, oldpath + "/") {
+      delete(m.nodes, p)
+      m.nodes[newpath + strings.TrimPrefix(p, oldpath)] = child
+    }
+  }
+
+  delete(m.nodes, oldpath)
+  m.nodes[newpath] = node
+  return nil
+}
+
+func (m *MemFS) Symlink(target, name string) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  resolved, err := m.parentDir("symlink", name)
+  if err != nil {
+    return err
+  }
+
+  if _, ok := m.nodes[resolved]; ok {
+    return memError("symlink", name, os.ErrExist)
+  }
+
+  m.nodes[resolved] = &memNode{
+    mode: os.ModeSymlink | os.ModePerm,
+    modTime: time.Now(),
+    target: filepath.ToSlash(target),
+  }
+
+  return nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  _, node, err := m.lookup("readlink", name, false)
+  if err != nil {
+    return "", err
+  }
+
+  if !IsSymlink(node.mode) {
+    return "", memError("readlink", name, errors.New("invalid argument"))
+  }
+
+  return node.target, nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  _, node, err := m.lookup("chmod", name, true)
+  if err != nil {
+    return err
+  }
+
+  node.mode = (node.mode &^ (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)) |
+    (mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+  return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  _, node, err := m.lookup("chtimes", name, true)
+  if err != nil {
+    return err
+  }
+
+  node.modTime = mtime
+  return nil
+}
+
+func (m *MemFS) Lchown(name string, uid, gid int) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  _, node, err := m.lookup("lchown", name, false)
+  if err != nil {
+    return err
+  }
+
+  node.uid, node.gid = uid, gid
+  return nil
+}
+
+// WriteFile creates the file with all parent directories, useful for setting up the state
+func (m *MemFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+  if err := m.MkdirAll(path.Dir(cleanMemPath(name)), DefaultDirMode); err != nil {
+    return err
+  }
+
+  f, err := m.OpenFile(name, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, perm)
+  if err != nil {
+    return err
+  }
+
+  if _, err = f.Write(data); err != nil {
+    f.Close()
+    return err
+  }
+
+  return f.Close()
+}
+
+func (f *memFile) Name() string {
+  return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+  if f.closed {
+    return 0, os.ErrClosed
+  }
+
+  if f.reader == nil {
+    return 0, memError("read", f.name, errors.New("bad file descriptor"))
+  }
+
+  return f.reader.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+  if f.closed {
+    return 0, os.ErrClosed
+  }
+
+  if !f.writable {
+    return 0, memError("write", f.name, errors.New("bad file descriptor"))
+  }
+
+  return f.buffer.Write(p)
+}
+
+func (f *memFile) Sync() error {
+  if f.closed {
+    return os.ErrClosed
+  }
+
+  return f.store()
+}
+
+func (f *memFile) Close() error {
+  if f.closed {
+    return os.ErrClosed
+  }
+
+  f.closed = true
+  return f.store()
+}
+
+// store puts written contents into the file system
+func (f *memFile) store() error {
+  if !f.writable {
+    return nil
+  }
+
+  f.fs.mutex.Lock()
+  defer f.fs.mutex.Unlock()
+
+  node, ok := f.fs.nodes[f.name]
+  if !ok {
+    // file was removed while open
+    return nil
+  }
+
+  node.data = append([]byte(nil), f.buffer.Bytes()...)
+  node.modTime = time.Now()
+  return nil
+}
+
+func (fi *memFileInfo) Name() string { return fi.name }
+func (fi *memFileInfo) Size() int64 { return int64(len(fi.node.data)) }
+func (fi *memFileInfo) Mode() os.FileMode { return fi.node.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi *memFileInfo) IsDir() bool { return fi.node.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{} { return nil }
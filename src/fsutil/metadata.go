@@ -0,0 +1,170 @@
+// Package fsutil contains file system helpers shared by the installer:
+// metadata and symlinks handling, platform specifics and the worker pool
+package fsutil
+
+import (
+  "encoding/binary"
+  "os"
+  "time"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  DefaultDirMode os.FileMode = 0755
+  DefaultFileMode os.FileMode = 0644
+
+  // Info-ZIP "new Unix" extra field with uid and gid
+  unixOwnerExtraID = 0x7875
+)
+
+// FileMetadata is what is carried from the package to the install dir
+// along with contents of the file
+type FileMetadata struct {
+  Mode os.FileMode
+  ModTime time.Time
+  Uid int
+  Gid int
+  HasOwner bool
+}
+
+// MetadataPolicy decides how metadata from the package is applied on disk.
+// nil policy applies permissions from the package as is
+type MetadataPolicy struct {
+  PreserveOwner bool
+  ApplyUmask bool
+  umask os.FileMode
+}
+
+func NewMetadataPolicy(preserveOwner, applyUmask bool) *MetadataPolicy {
+  return &MetadataPolicy{
+    PreserveOwner: preserveOwner,
+    ApplyUmask: applyUmask,
+    umask: CurrentUmask(),
+  }
+}
+
+func MetadataFromFileInfo(fi os.FileInfo) *FileMetadata {
+  md := &FileMetadata{
+    Mode: fi.Mode(),
+    ModTime: fi.ModTime(),
+  }
+
+  md.Uid, md.Gid, md.HasOwner = FileOwner(fi)
+
+  return md
+}
+
+// Permissions returns sane permission bits for the mode from the package:
+// missing permissions are replaced with defaults and directories
+// are always accessible by the owner
+func (mp *MetadataPolicy) Permissions(mode os.FileMode, isDir bool) os.FileMode {
+  if mp == nil {
+    mp = &MetadataPolicy{}
+  }
+
+  perm := mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+  if perm.Perm() == 0 {
+    if isDir {
+      perm |= DefaultDirMode
+    } else {
+      perm |= DefaultFileMode
+    }
+  }
+
+  if isDir {
+    perm |= 0700
+  }
+
+  if !mp.PreserveOwner {
+    // setuid bits with somebody else's ownership are not wanted
+    perm &^= os.ModeSetuid | os.ModeSetgid
+  }
+
+  if mp.ApplyUmask {
+    perm &^= mp.umask
+  }
+
+  return perm
+}
+
+// Apply sets mode, modification time and (optionally) ownership of path.
+// Only failure to set the mode is considered to be an error
+func (mp *MetadataPolicy) Apply(fsys FS, path string, md *FileMetadata, isDir bool) error {
+  if mp == nil {
+    mp = &MetadataPolicy{}
+  }
+
+  if md.Mode & os.ModeSymlink != 0 {
+    // chmod and chtimes would follow the link
+    if mp.PreserveOwner && md.HasOwner {
+      if err := fsys.Lchown(path, md.Uid, md.Gid); err != nil {
+        logging.WithFields(logging.Fields{logging.FieldOp: "chown", logging.FieldPath: path, logging.FieldError: err}).Warnf("Failed to set owner")
+      }
+    }
+
+    return nil
+  }
+
+  // chown clears setuid and setgid bits so it goes before chmod
+  if mp.PreserveOwner && md.HasOwner {
+    if err := fsys.Lchown(path, md.Uid, md.Gid); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldOp: "chown", logging.FieldPath: path, logging.FieldError: err}).Warnf("Failed to set owner")
+    }
+  }
+
+  err := fsys.Chmod(path, mp.Permissions(md.Mode, isDir))
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "chmod", logging.FieldPath: path, logging.FieldError: err}).Errorf("Failed to set mode")
+    return err
+  }
+
+  if !md.ModTime.IsZero() {
+    if err := fsys.Chtimes(path, md.ModTime, md.ModTime); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldOp: "chtimes", logging.FieldPath: path, logging.FieldError: err}).Warnf("Failed to set modification time")
+    }
+  }
+
+  return nil
+}
+
+// ParseUnixOwner reads uid and gid from zip extra fields if present
+func ParseUnixOwner(extra []byte) (uid, gid int, ok bool) {
+  for len(extra) >= 4 {
+    id := binary.LittleEndian.Uint16(extra[0:2])
+    size := int(binary.LittleEndian.Uint16(extra[2:4]))
+    extra = extra[4:]
+    if size > len(extra) {
+      return 0, 0, false
+    }
+
+    data := extra[:size]
+    extra = extra[size:]
+
+    if id != unixOwnerExtraID || len(data) < 2 {
+      continue
+    }
+
+    // version(1) uidSize(1) uid(uidSize) gidSize(1) gid(gidSize)
+    uidSize := int(data[1])
+    if len(data) < 2 + uidSize + 1 { return 0, 0, false }
+    uid = int(readLittleEndian(data[2:2 + uidSize]))
+
+    gidSize := int(data[2 + uidSize])
+    gidStart := 3 + uidSize
+    if len(data) < gidStart + gidSize { return 0, 0, false }
+    gid = int(readLittleEndian(data[gidStart:gidStart + gidSize]))
+
+    return uid, gid, true
+  }
+
+  return 0, 0, false
+}
+
+func readLittleEndian(b []byte) uint64 {
+  var v uint64
+  for i := len(b) - 1; i >= 0; i-- {
+    v = (v << 8) | uint64(b[i])
+  }
+  return v
+}
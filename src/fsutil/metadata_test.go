@@ -0,0 +1,86 @@
+package fsutil
+
+import (
+  "encoding/binary"
+  "os"
+  "testing"
+)
+
+// unixOwnerExtra builds Info-ZIP "new Unix" extra field with sizes of uid and gid
+func unixOwnerExtra(uid, gid uint32, size int) []byte {
+  data := []byte{1, byte(size)}
+  id := make([]byte, 4)
+  binary.LittleEndian.PutUint32(id, uid)
+  data = append(data, id[:size]...)
+  data = append(data, byte(size))
+  binary.LittleEndian.PutUint32(id, gid)
+  data = append(data, id[:size]...)
+
+  return extraField(unixOwnerExtraID, data)
+}
+
+func extraField(id uint16, data []byte) []byte {
+  header := make([]byte, 4)
+  binary.LittleEndian.PutUint16(header[0:2], id)
+  binary.LittleEndian.PutUint16(header[2:4], uint16(len(data)))
+  return append(header, data...)
+}
+
+func TestParseUnixOwner(t *testing.T) {
+  owner := unixOwnerExtra(1000, 100, 4)
+
+  tests := []struct {
+    name string
+    extra []byte
+    uid int
+    gid int
+    ok bool
+  }{
+    {"empty", nil, 0, 0, false},
+    {"4 byte ids", owner, 1000, 100, true},
+    {"2 byte ids", unixOwnerExtra(501, 20, 2), 501, 20, true},
+    {"after other field", append(extraField(0x5455, []byte{1, 2, 3, 4, 5}), owner...), 1000, 100, true},
+    {"other field only", extraField(0x5455, []byte{1, 2, 3, 4, 5}), 0, 0, false},
+    {"truncated field", owner[:len(owner) - 2], 0, 0, false},
+    {"truncated gid", extraField(unixOwnerExtraID, []byte{1, 4, 0xe8, 3, 0, 0, 4, 100}), 0, 0, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      uid, gid, ok := ParseUnixOwner(tt.extra)
+      if ok != tt.ok || uid != tt.uid || gid != tt.gid {
+        t.Fatalf("got uid %v gid %v ok %v, expected uid %v gid %v ok %v", uid, gid, ok, tt.uid, tt.gid, tt.ok)
+      }
+    })
+  }
+}
+
+func TestPermissions(t *testing.T) {
+  tests := []struct {
+    name string
+    policy *MetadataPolicy
+    mode os.FileMode
+    isDir bool
+    want os.FileMode
+  }{
+    {"nil policy", nil, 0640, false, 0640},
+    {"file without permissions", &MetadataPolicy{}, 0, false, DefaultFileMode},
+    {"dir without permissions", &MetadataPolicy{}, os.ModeDir, true, DefaultDirMode},
+    {"dir is accessible by owner", &MetadataPolicy{}, os.ModeDir | 0055, true, 0755},
+    {"type bits dropped", &MetadataPolicy{}, os.ModeSymlink | 0777, false, 0777},
+    {"setuid stripped", &MetadataPolicy{}, os.ModeSetuid | os.ModeSetgid | 0755, false, 0755},
+    {"setuid kept with owner", &MetadataPolicy{PreserveOwner: true}, os.ModeSetuid | 0755, false, os.ModeSetuid | 0755},
+    {"sticky kept", &MetadataPolicy{}, os.ModeDir | os.ModeSticky | 0777, true, os.ModeSticky | 0777},
+    {"umask applied", &MetadataPolicy{ApplyUmask: true, umask: 0027}, 0666, false, 0640},
+    {"umask ignored", &MetadataPolicy{umask: 0027}, 0666, false, 0666},
+    {"umask after defaults", &MetadataPolicy{ApplyUmask: true, umask: 0077}, os.ModeDir, true, 0700},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if got := tt.policy.Permissions(tt.mode, tt.isDir); got != tt.want {
+        t.Fatalf("got %v, expected %v", got, tt.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,150 @@
+// +build !windows
+
+package fsutil
+
+import (
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+)
+
+func ExecutablePath() string {
+  exepath, err := os.Executable()
+  if err != nil {
+    exepath, err = os.Readlink("/proc/self/exe")
+  }
+
+  if err != nil {
+    exepath, _ = exec.LookPath(os.Args[0])
+    return exepath
+  }
+
+  if resolved, err := filepath.EvalSymlinks(exepath); err == nil {
+    exepath = resolved
+  }
+
+  return exepath
+}
+
+// RemoveFileLater is used for the backup of the running installer.
+// Running executables can be unlinked right away on Unix
+func RemoveFileLater(fullpath string) error {
+  return os.Remove(fullpath)
+}
+
+// RemoveOnReboot removes the file right away
+// since files in use can be unlinked on Unix
+func RemoveOnReboot(fullpath string) error {
+  return os.Remove(fullpath)
+}
+
+// CheckRenamable only checks that the file exists since
+// renaming on Unix depends just on the directory permissions
+func CheckRenamable(fullpath string) error {
+  _, err := os.Lstat(fullpath)
+  return err
+}
+
+func DetachProcess(cmd *exec.Cmd) {
+  // own session so the app survives the installer and its terminal
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// IsProcessRunning checks whether any process runs the executable
+func IsProcessRunning(exepath string) (bool, error) {
+  if abspath, err := filepath.Abs(exepath); err == nil {
+    exepath = abspath
+  }
+
+  if resolved, err := filepath.EvalSymlinks(exepath); err == nil {
+    exepath = resolved
+  }
+
+  entries, err := ioutil.ReadDir("/proc")
+  if err != nil {
+    // no procfs e.g. on macOS
+    return isProcessListed(exepath)
+  }
+
+  for _, fi := range entries {
+    if !fi.IsDir() || strings.Trim(fi.Name(), "0123456789") != "" {
+      continue
+    }
+
+    // processes of other users are not readable, they are skipped
+    target, err := os.Readlink(filepath.Join("/proc", fi.Name(), "exe"))
+    if err == nil && strings.TrimSuffix(target, " (deleted)") == exepath {
+      return true, nil
+    }
+  }
+
+  return false, nil
+}
+
+func isProcessListed(exepath string) (bool, error) {
+  out, err := exec.Command("ps", "-axo", "comm=").Output()
+  if err != nil {
+    return false, err
+  }
+
+  for _, line := range strings.Split(string(out), "\n") {
+    if strings.TrimSpace(line) == exepath {
+      return true, nil
+    }
+  }
+
+  return false, nil
+}
+
+func FileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, 0, false
+  }
+
+  return int(st.Uid), int(st.Gid), true
+}
+
+// startUmask is the umask of the process when it started. It is read by
+// setting it, which is safe only before any goroutine creates files
+var startUmask = func() os.FileMode {
+  mask := syscall.Umask(0)
+  syscall.Umask(mask)
+  return os.FileMode(mask)
+}()
+
+// CurrentUmask reads the umask without changing it where it is possible
+// (Linux), otherwise umask of the process at the start is returned
+func CurrentUmask() os.FileMode {
+  data, err := ioutil.ReadFile("/proc/self/status")
+  if err != nil {
+    return startUmask
+  }
+
+  for _, line := range strings.Split(string(data), "\n") {
+    if !strings.HasPrefix(line, "Umask:") {
+      continue
+    }
+
+    mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "Umask:")), 8, 32)
+    if err == nil {
+      return os.FileMode(mask)
+    }
+  }
+
+  return startUmask
+}
+
+func FreeDiskSpace(path string) (uint64, error) {
+  var st syscall.Statfs_t
+  if err := syscall.Statfs(path, &st); err != nil {
+    return 0, err
+  }
+
+  // space available to unprivileged users
+  return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,21 @@
+package fsutil
+
+import (
+  "os"
+  "syscall"
+  "testing"
+)
+
+func TestCurrentUmask(t *testing.T) {
+  // the only place where the umask is changed on purpose
+  previous := syscall.Umask(0027)
+  defer syscall.Umask(previous)
+
+  if mask := CurrentUmask(); mask != 0027 {
+    t.Fatalf("got umask %v, expected %v", mask, os.FileMode(0027))
+  }
+
+  if mask := syscall.Umask(0027); mask != 0027 {
+    t.Fatalf("umask was changed to %v", os.FileMode(mask))
+  }
+}
@@ -0,0 +1,135 @@
+package fsutil
+
+import (
+  "syscall"
+  "unicode/utf16"
+  "unsafe"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+)
+
+var (
+  kernel = syscall.MustLoadDLL("kernel32.dll")
+  getModuleFileNameProc = kernel.MustFindProc("GetModuleFileNameW")
+  getDiskFreeSpaceExProc = kernel.MustFindProc("GetDiskFreeSpaceExW")
+  moveFileExProc = kernel.MustFindProc("MoveFileExW")
+)
+
+const (
+  moveFileDelayUntilReboot = 0x4
+  deleteAccess = 0x10000
+)
+
+func getModuleFileName() (string, error) {
+  var n uint32
+  b := make([]uint16, syscall.MAX_PATH)
+  size := uint32(len(b))
+
+  ret, _, err := getModuleFileNameProc.Call(0, uintptr(unsafe.Pointer(&b[0])), uintptr(size))
+  n = uint32(ret)
+  if n == 0 {
+    return "", err
+  }
+
+  return string(utf16.Decode(b[0:n])), nil
+}
+
+func ExecutablePath() string {
+  exepath, err := getModuleFileName()
+  if err != nil {
+    exepath, _ = exec.LookPath(os.Args[0])
+  }
+
+  return filepath.ToSlash(exepath)
+}
+
+const (
+  detachedProcess = 0x00000008
+)
+
+func DetachProcess(cmd *exec.Cmd) {
+  cmd.SysProcAttr = &syscall.SysProcAttr{
+    CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+  }
+}
+
+// IsProcessRunning checks whether any process runs the executable,
+// only the name of the executable is compared
+func IsProcessRunning(exepath string) (bool, error) {
+  name := filepath.Base(filepath.FromSlash(exepath))
+  out, err := exec.Command("tasklist", "/FO", "CSV", "/NH", "/FI", "IMAGENAME eq " + name).Output()
+  if err != nil {
+    return false, err
+  }
+
+  return strings.Contains(strings.ToLower(string(out)), "\"" + strings.ToLower(name) + "\""), nil
+}
+
+func FileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+  return 0, 0, false
+}
+
+func CurrentUmask() os.FileMode {
+  return 0
+}
+
+// RemoveFileLater removes the file after the installer exits
+// since running executable cannot be removed on Windows
+func RemoveFileLater(fullpath string) error {
+  cmd := exec.Command("cmd", "/C", "ping localhost -n 2 -w 5000 > nul & del", filepath.FromSlash(fullpath))
+  return cmd.Start()
+}
+
+// RemoveOnReboot schedules removal of the file which is in use
+// until the next reboot, usually it requires administrator rights
+func RemoveOnReboot(fullpath string) error {
+  pathPtr, err := syscall.UTF16PtrFromString(filepath.FromSlash(fullpath))
+  if err != nil {
+    return err
+  }
+
+  ret, _, err := moveFileExProc.Call(uintptr(unsafe.Pointer(pathPtr)), 0, moveFileDelayUntilReboot)
+  if ret == 0 {
+    return err
+  }
+
+  return nil
+}
+
+// CheckRenamable opens the file with the access rename needs. Nothing is
+// changed but it fails if the file is open without delete sharing
+func CheckRenamable(fullpath string) error {
+  pathPtr, err := syscall.UTF16PtrFromString(filepath.FromSlash(fullpath))
+  if err != nil {
+    return err
+  }
+
+  handle, err := syscall.CreateFile(pathPtr, deleteAccess,
+    syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE,
+    nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS | syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+  if err != nil {
+    return &os.PathError{Op: "rename", Path: fullpath, Err: err}
+  }
+
+  return syscall.CloseHandle(handle)
+}
+
+func FreeDiskSpace(path string) (uint64, error) {
+  pathPtr, err := syscall.UTF16PtrFromString(filepath.FromSlash(path))
+  if err != nil {
+    return 0, err
+  }
+
+  var freeBytesAvailable, totalBytes, totalFreeBytes uint64
+  ret, _, err := getDiskFreeSpaceExProc.Call(uintptr(unsafe.Pointer(pathPtr)),
+    uintptr(unsafe.Pointer(&freeBytesAvailable)),
+    uintptr(unsafe.Pointer(&totalBytes)),
+    uintptr(unsafe.Pointer(&totalFreeBytes)))
+  if ret == 0 {
+    return 0, err
+  }
+
+  return freeBytesAvailable, nil
+}
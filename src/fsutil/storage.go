@@ -0,0 +1,8 @@
+// +build !linux
+
+package fsutil
+
+func IsRotationalStorage(path string) bool {
+  // storage type is not detected on this platform
+  return false
+}
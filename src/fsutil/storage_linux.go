@@ -0,0 +1,38 @@
+package fsutil
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+  "syscall"
+)
+
+func IsRotationalStorage(path string) bool {
+  var st syscall.Stat_t
+  if err := syscall.Stat(path, &st); err != nil {
+    return false
+  }
+
+  dev := uint64(st.Dev)
+  major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+  minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+
+  // partitions do not have a queue of their own, it belongs to parent device
+  candidates := []string{
+    fmt.Sprintf("/sys/dev/block/%d:%d/queue/rotational", major, minor),
+    fmt.Sprintf("/sys/dev/block/%d:%d/../queue/rotational", major, minor),
+  }
+
+  for _, candidate := range candidates {
+    data, err := ioutil.ReadFile(candidate)
+    if err != nil {
+      if os.IsNotExist(err) { continue }
+      return false
+    }
+
+    return strings.TrimSpace(string(data)) == "1"
+  }
+
+  return false
+}
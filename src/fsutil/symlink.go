@@ -0,0 +1,207 @@
+package fsutil
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strings"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // prefix of the "hash" of symlinks, they are compared by target
+  symlinkHashPrefix = "symlink:"
+  // same limit as Linux has for path resolution
+  maxSymlinkHops = 40
+)
+
+var (
+  ErrPathEscapes = errors.New("path escapes the destination directory")
+  ErrSymlinkLoop = errors.New("too many levels of symbolic links")
+)
+
+func IsSymlink(mode os.FileMode) bool {
+  return mode & os.ModeSymlink != 0
+}
+
+func IsFileOrSymlink(mode os.FileMode) bool {
+  return mode.IsRegular() || IsSymlink(mode)
+}
+
+func SymlinkHash(target string) string {
+  return symlinkHashPrefix + filepath.ToSlash(target)
+}
+
+func SymlinkFromHash(hash string) (target string, ok bool) {
+  if !strings.HasPrefix(hash, symlinkHashPrefix) {
+    return "", false
+  }
+
+  return strings.TrimPrefix(hash, symlinkHashPrefix), true
+}
+
+// SafeJoin joins archive entry name to dest making sure it stays inside
+func SafeJoin(dest, name string) (string, error) {
+  name = filepath.ToSlash(name)
+  cleaned := path.Clean(name)
+
+  if path.IsAbs(name) || filepath.VolumeName(name) != "" ||
+     cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+    return "", fmt.Errorf("%v: %v", name, ErrPathEscapes)
+  }
+
+  return filepath.Join(dest, filepath.FromSlash(cleaned)), nil
+}
+
+// CheckNoSymlinkParents makes sure that no directory between root and
+// fullpath is a symlink. Otherwise a chain of symlinks which all point
+// inside of root (like a -> . and b -> a/..) could redirect the write outside
+func CheckNoSymlinkParents(fsys FS, root, fullpath string) error {
+  reldir, err := filepath.Rel(root, filepath.Dir(fullpath))
+  if err != nil {
+    return err
+  }
+
+  reldir = filepath.ToSlash(reldir)
+  if reldir == "." {
+    return nil
+  }
+
+  if reldir == ".." || strings.HasPrefix(reldir, "../") {
+    return fmt.Errorf("%v: %v", fullpath, ErrPathEscapes)
+  }
+
+  current := root
+  for _, part := range strings.Split(reldir, "/") {
+    current = filepath.Join(current, part)
+
+    fi, err := fsys.Lstat(current)
+    if os.IsNotExist(err) {
+      // the rest of the path does not exist yet and will be created
+      return nil
+    }
+
+    if err != nil {
+      return err
+    }
+
+    if IsSymlink(fi.Mode()) {
+      return fmt.Errorf("%v: parent %v is a symlink: %v", fullpath, current, ErrPathEscapes)
+    }
+  }
+
+  return nil
+}
+
+func isAbsLinkTarget(target string) bool {
+  return path.IsAbs(target) || filepath.IsAbs(target) || filepath.VolumeName(target) != ""
+}
+
+func splitLinkPath(p string) []string {
+  return strings.Split(filepath.ToSlash(p), "/")
+}
+
+// ValidateLinkTarget checks that symlink at relpath points inside of the root.
+// links maps relative paths of all other symlinks in the root to their targets:
+// the target is resolved through them the way the OS does it, because
+// links which point inside one by one (like a -> . and b -> a/..)
+// can point outside together
+func ValidateLinkTarget(relpath, target string, links map[string]string) error {
+  if isAbsLinkTarget(target) {
+    return fmt.Errorf("symlink %v -> %v: %v", relpath, target, ErrPathEscapes)
+  }
+
+  // real directories from the root to the current component
+  resolved := make([]string, 0)
+  pending := append(splitLinkPath(path.Dir(filepath.ToSlash(relpath))), splitLinkPath(target)...)
+  hops := 0
+
+  for len(pending) > 0 {
+    part := pending[0]
+    pending = pending[1:]
+
+    switch part {
+    case "", ".":
+      continue
+    case "..":
+      if len(resolved) == 0 {
+        return fmt.Errorf("symlink %v -> %v: %v", relpath, target, ErrPathEscapes)
+      }
+
+      resolved = resolved[:len(resolved) - 1]
+      continue
+    }
+
+    linkTarget, ok := links[path.Join(append(resolved, part)...)]
+    if !ok {
+      resolved = append(resolved, part)
+      continue
+    }
+
+    if hops++; hops > maxSymlinkHops {
+      return fmt.Errorf("symlink %v -> %v: %v", relpath, target, ErrSymlinkLoop)
+    }
+
+    if isAbsLinkTarget(linkTarget) {
+      return fmt.Errorf("symlink %v -> %v: %v", relpath, target, ErrPathEscapes)
+    }
+
+    // the target of the link is relative to the dir of the link
+    pending = append(splitLinkPath(linkTarget), pending...)
+  }
+
+  return nil
+}
+
+// ValidateLinks checks every symlink from links (relative path to target)
+func ValidateLinks(links map[string]string) error {
+  relpaths := make([]string, 0, len(links))
+  for relpath := range links {
+    relpaths = append(relpaths, relpath)
+  }
+
+  sort.Strings(relpaths)
+
+  for _, relpath := range relpaths {
+    if err := ValidateLinkTarget(relpath, links[relpath], links); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// CreateSymlink replaces whatever is at fullpath with a symlink to target
+func (mp *MetadataPolicy) CreateSymlink(fsys FS, target, fullpath string, md *FileMetadata) error {
+  logging.WithFields(logging.Fields{logging.FieldOp: "symlink", logging.FieldPath: fullpath}).Debugf("Creating symlink to %v", target)
+
+  if err := fsys.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  err := fsys.Symlink(target, fullpath)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "symlink", logging.FieldPath: fullpath, logging.FieldError: err}).Errorf("Failed to create symlink")
+    return err
+  }
+
+  if md != nil {
+    return mp.Apply(fsys, fullpath, md, false)
+  }
+
+  return nil
+}
+
+func ReadSymlinkTarget(r io.Reader) (string, error) {
+  data, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+  if err != nil {
+    return "", err
+  }
+
+  return string(data), nil
+}
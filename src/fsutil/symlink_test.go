@@ -0,0 +1,40 @@
+package fsutil
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestValidateLinks(t *testing.T) {
+  tests := []struct {
+    name string
+    links map[string]string
+    wantErr error
+  }{
+    {"none", nil, nil},
+    {"sibling", map[string]string{"dir/a": "b"}, nil},
+    {"root", map[string]string{"dir/a": ".."}, nil},
+    {"absolute", map[string]string{"a": "/etc/passwd"}, ErrPathEscapes},
+    {"parent", map[string]string{"dir/a": "../../b"}, ErrPathEscapes},
+    {"link to root", map[string]string{"a": ".", "b": "a/a/a"}, nil},
+    {"parent link chain", map[string]string{"a": ".", "b": "a/.."}, ErrPathEscapes},
+    {"parent through nested link", map[string]string{"dir/a": "..", "b": "dir/a/dir/a/.."}, ErrPathEscapes},
+    {"link to link dir", map[string]string{"dir/a": "../other", "other": "dir", "b": "dir/a/.."}, nil},
+    {"absolute through link", map[string]string{"a": "/tmp", "b": "a/file"}, ErrPathEscapes},
+    {"loop", map[string]string{"a": "b", "b": "a"}, ErrSymlinkLoop},
+    {"self", map[string]string{"a": "a"}, ErrSymlinkLoop},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      err := ValidateLinks(tt.links)
+      if tt.wantErr == nil && err != nil {
+        t.Fatalf("unexpected error: %v", err)
+      }
+
+      if tt.wantErr != nil && (err == nil || !strings.Contains(err.Error(), tt.wantErr.Error())) {
+        t.Fatalf("got error %v, expected %v", err, tt.wantErr)
+      }
+    })
+  }
+}
@@ -0,0 +1,109 @@
+package fsutil
+
+import (
+  "runtime"
+  "sync"
+  "log"
+)
+
+const (
+  rotationalConcurrency = 2
+  maxConcurrency = 32
+)
+
+// WorkerPool limits the number of goroutines doing file I/O at the same time.
+// It is shared between hashing and diffing so the whole process never keeps
+// more than a fixed number of files open
+type WorkerPool struct {
+  slots chan struct{}
+}
+
+// WorkGroup is a set of jobs executed in the pool with the first error kept
+type WorkGroup struct {
+  pool *WorkerPool
+  wg sync.WaitGroup
+  errMutex sync.Mutex
+  err error
+}
+
+func NewWorkerPool(concurrency int) *WorkerPool {
+  if concurrency <= 0 {
+    concurrency = 1
+  }
+
+  log.Printf("Using worker pool with concurrency %v", concurrency)
+
+  return &WorkerPool{
+    slots: make(chan struct{}, concurrency),
+  }
+}
+
+// DefaultConcurrency picks a concurrency level for files under path:
+// spinning disks are thrashed by parallel reads so only a couple of workers
+// are used for them, solid state storage gets a few workers per CPU
+func DefaultConcurrency(path string) int {
+  if IsRotationalStorage(path) {
+    return rotationalConcurrency
+  }
+
+  concurrency := runtime.NumCPU() * 2
+  if concurrency > maxConcurrency {
+    concurrency = maxConcurrency
+  }
+
+  return concurrency
+}
+
+func (wp *WorkerPool) NewGroup() *WorkGroup {
+  return &WorkGroup{pool: wp}
+}
+
+// Go blocks until a free slot is available in the pool and runs job in it.
+// Jobs are skipped once any job of the group has failed
+func (g *WorkGroup) Go(job func() error) {
+  if g.Err() != nil {
+    return
+  }
+
+  g.pool.slots <- struct{}{}
+  // the group could fail while waiting for the slot
+  if g.Err() != nil {
+    <- g.pool.slots
+    return
+  }
+
+  g.wg.Add(1)
+
+  go func() {
+    defer func() {
+      <- g.pool.slots
+      g.wg.Done()
+    }()
+
+    if err := job(); err != nil {
+      g.setErr(err)
+    }
+  }()
+}
+
+func (g *WorkGroup) setErr(err error) {
+  g.errMutex.Lock()
+  defer g.errMutex.Unlock()
+
+  if g.err == nil {
+    g.err = err
+  }
+}
+
+// Err returns the first error of the group if any
+func (g *WorkGroup) Err() error {
+  g.errMutex.Lock()
+  defer g.errMutex.Unlock()
+  return g.err
+}
+
+// Wait waits for all started jobs and returns the first error
+func (g *WorkGroup) Wait() error {
+  g.wg.Wait()
+  return g.Err()
+}
@@ -0,0 +1,145 @@
+package fsutil
+
+import (
+  "crypto/sha1"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "sync"
+  "sync/atomic"
+  "testing"
+)
+
+func TestWorkGroupError(t *testing.T) {
+  errJob := errors.New("job failed")
+
+  tests := []struct {
+    name string
+    // index of the failing job
+    failing int
+    jobs int
+  }{
+    {"first", 0, 10},
+    {"middle", 5, 10},
+    {"last", 9, 10},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      group := NewWorkerPool(1).NewGroup()
+      var started int32
+
+      for i := 0; i < tt.jobs; i++ {
+        i := i
+        group.Go(func() error {
+          atomic.AddInt32(&started, 1)
+          if i == tt.failing {
+            return errJob
+          }
+
+          return nil
+        })
+      }
+
+      if err := group.Wait(); err != errJob {
+        t.Fatalf("Wait returned %v instead of the job error", err)
+      }
+
+      // with a single slot nothing starts after the failed job
+      if int(started) != tt.failing + 1 {
+        t.Fatalf("%v jobs started, expected %v", started, tt.failing + 1)
+      }
+    })
+  }
+}
+
+// generateTree creates count files of the given size and returns their paths
+func generateTree(b *testing.B, count, size int) []string {
+  root := b.TempDir()
+  rnd := rand.New(rand.NewSource(1))
+  data := make([]byte, size)
+  paths := make([]string, 0, count)
+
+  for i := 0; i < count; i++ {
+    dir := filepath.Join(root, fmt.Sprintf("dir%v", i % 10))
+    if err := os.MkdirAll(dir, 0755); err != nil {
+      b.Fatal(err)
+    }
+
+    fullpath := filepath.Join(dir, fmt.Sprintf("file%v.bin", i))
+    rnd.Read(data)
+    if err := ioutil.WriteFile(fullpath, data, 0644); err != nil {
+      b.Fatal(err)
+    }
+
+    paths = append(paths, fullpath)
+  }
+
+  return paths
+}
+
+func hashFile(fullpath string) error {
+  f, err := os.Open(fullpath)
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  _, err = io.Copy(sha1.New(), f)
+  return err
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+  paths := generateTree(b, 1000, 16 * 1024)
+
+  for _, concurrency := range []int{1, 4, 16} {
+    b.Run(fmt.Sprintf("concurrency-%v", concurrency), func(b *testing.B) {
+      pool := NewWorkerPool(concurrency)
+      b.ResetTimer()
+
+      for i := 0; i < b.N; i++ {
+        group := pool.NewGroup()
+        for _, fullpath := range paths {
+          fullpath := fullpath
+          group.Go(func() error {
+            return hashFile(fullpath)
+          })
+        }
+
+        if err := group.Wait(); err != nil {
+          b.Fatal(err)
+        }
+      }
+    })
+  }
+
+  // the way files were hashed before the pool
+  b.Run("goroutine-per-file", func(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+      var wg sync.WaitGroup
+      errs := make(chan error, len(paths))
+
+      for _, fullpath := range paths {
+        wg.Add(1)
+        go func(fullpath string) {
+          defer wg.Done()
+          if err := hashFile(fullpath); err != nil {
+            errs <- err
+          }
+        }(fullpath)
+      }
+
+      wg.Wait()
+      close(errs)
+
+      if err := <- errs; err != nil {
+        b.Fatal(err)
+      }
+    }
+  })
+}
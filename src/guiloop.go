@@ -4,26 +4,36 @@ package main
 
 import (
   "log"
+  "os"
+  "github.com/ribtoks/ministaller/src/ministaller"
+)
+
+const (
+  // progress is rendered to stdout instead of the window
+  guiUsesTerminal = true
 )
 
 var (
   finished = make(chan bool)
 )
 
-func NewUIProgressHandler() ProgressHandler {
-  return &UIProgressHandler{}
+func NewUIProgressHandler() ministaller.StatsProgressHandler {
+  return &UIProgressHandler{
+    TerminalProgressHandler: ministaller.NewTerminalProgressHandler(os.Stdout),
+  }
 }
 
 type UIProgressHandler struct {
-  LogProgressHandler
+  *ministaller.TerminalProgressHandler
 }
 
 func (ph *UIProgressHandler) HandleFinish() {
+  ph.TerminalProgressHandler.HandleFinish()
   log.Printf("Finished")
   finished <- true
 }
 
-func guiinit() {
+func guiinit(cancel func()) {
   // do nothing
 }
 
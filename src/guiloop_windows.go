@@ -1,8 +1,14 @@
 package main
 
 import (
+  "sync"
   "github.com/ribtoks/gform"
   "github.com/ribtoks/w32"
+  "github.com/ribtoks/ministaller/src/ministaller"
+)
+
+const (
+  guiUsesTerminal = false
 )
 
 var (
@@ -12,26 +18,57 @@ var (
   lb *gform.Label
 )
 
-func NewUIProgressHandler() ProgressHandler {
+func NewUIProgressHandler() ministaller.StatsProgressHandler {
   return &WinUIProgressHandler{}
 }
 
 type WinUIProgressHandler struct {
+  mutex sync.Mutex
+  message string
+  details string
 }
 
-func (ph *WinUIProgressHandler) HandlePercentChange(percent int) {
-  pb.SetValue(uint32(percent))
+func (ph *WinUIProgressHandler) HandleProgress(stats *ministaller.ProgressStats) {
+  pb.SetValue(uint32(stats.Percent))
+
+  ph.mutex.Lock()
+  defer ph.mutex.Unlock()
+
+  ph.details = stats.String()
+  ph.updateCaption()
 }
 
 func (ph *WinUIProgressHandler) HandleSystemMessage(msg string) {
-  lb.SetCaption(msg)
+  ph.mutex.Lock()
+  defer ph.mutex.Unlock()
+
+  ph.message = msg
+  ph.details = ""
+  ph.updateCaption()
+}
+
+func (ph *WinUIProgressHandler) updateCaption() {
+  if len(ph.details) > 0 {
+    lb.SetCaption(ph.message + " " + ph.details)
+  } else {
+    lb.SetCaption(ph.message)
+  }
+}
+
+func (ph *WinUIProgressHandler) PromptRetry(message string) bool {
+  result := gform.MsgBox(mw, "ministaller", message, w32.MB_RETRYCANCEL | w32.MB_ICONWARNING)
+  return result == w32.IDRETRY
+}
+
+func (ph *WinUIProgressHandler) NotifyError(message string) {
+  gform.MsgBox(mw, "ministaller", message, w32.MB_OK | w32.MB_ICONERROR)
 }
 
 func (ph *WinUIProgressHandler) HandleFinish() {
   guifinish()
 }
 
-func guiinit() {
+func guiinit(cancel func()) {
   gform.Init()
 
   mw = gform.NewForm(nil)
@@ -40,7 +77,11 @@ func guiinit() {
   mw.EnableMaxButton(false)
   mw.EnableSizable(false)
   mw.OnClose().Bind(func (arg *gform.EventArg) {
-    gform.MsgBox(arg.Sender().Parent(), "Info", "Please wait for the installation to finish", w32.MB_OK | w32.MB_ICONWARNING)
+    answer := gform.MsgBox(arg.Sender().Parent(), "Cancel", "Do you want to cancel the installation?", w32.MB_YESNO | w32.MB_ICONQUESTION)
+    if answer == w32.IDYES {
+      lb.SetCaption("Cancelling the installation...")
+      cancel()
+    }
   });
 
   lb = gform.NewLabel(mw)
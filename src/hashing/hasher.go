@@ -0,0 +1,118 @@
+// Package hashing calculates hashes of files in the install and package dirs
+package hashing
+
+import (
+  "context"
+  "crypto/sha1"
+  "os"
+  "io"
+  "encoding/hex"
+  "path/filepath"
+  "sync"
+  "log"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+// CalculateHashes returns hashes of all files and symlinks under root
+// keyed by slash-separated relative path
+func CalculateHashes(ctx context.Context, fsys fsutil.FS, root string, pool *fsutil.WorkerPool) (map[string]string, error) {
+  var mutex sync.Mutex
+  m := make(map[string]string)
+
+  group := pool.NewGroup()
+
+  err := fsutil.Walk(fsys, root, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if err = group.Err(); err != nil {
+      return err
+    }
+
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+
+    if !fsutil.IsFileOrSymlink(info.Mode()) {
+      return nil
+    }
+
+    mode := info.Mode()
+
+    group.Go(func() error {
+      hash, err := CalculateEntryHash(fsys, path, mode)
+      if err != nil {
+        logging.WithFields(logging.Fields{logging.FieldOp: "hash", logging.FieldPath: path, logging.FieldError: err}).Errorf("Error while calculating hash")
+        return err
+      }
+
+      key, err := filepath.Rel(root, path)
+      if err != nil {
+        logging.WithFields(logging.Fields{logging.FieldPath: path, logging.FieldError: err}).Errorf("Error while calculating relative path")
+        return err
+      }
+
+      mutex.Lock()
+      m[filepath.ToSlash(key)] = hash
+      mutex.Unlock()
+
+      return nil
+    })
+
+    return nil
+  })
+
+  if werr := group.Wait(); err == nil {
+    err = werr
+  }
+
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "hash", logging.FieldPath: root, logging.FieldError: err}).Errorf("Error while hashing")
+    return nil, err
+  }
+
+  log.Printf("Hashes accounting finished")
+
+  return m, nil
+}
+
+// CalculateEntryHash hashes contents of regular files
+// while symlinks are represented by their target
+func CalculateEntryHash(fsys fsutil.FS, path string, mode os.FileMode) (string, error) {
+  if fsutil.IsSymlink(mode) {
+    target, err := fsys.Readlink(path)
+    if err != nil {
+      return "", err
+    }
+
+    return fsutil.SymlinkHash(target), nil
+  }
+
+  return HashFile(fsys, path)
+}
+
+func CalculateFileHash(filepath string) (string, error) {
+  return HashFile(fsutil.OS, filepath)
+}
+
+// HashFile returns hex encoded SHA1 of the file contents
+func HashFile(fsys fsutil.FS, filepath string) (string, error) {
+  f, err := fsys.Open(filepath)
+  if err != nil {
+    return "", err
+  }
+
+  defer f.Close()
+
+  hasher := sha1.New()
+
+  if _, err := io.Copy(hasher, f); err != nil {
+    return "", err
+  }
+
+  hashBytes := hasher.Sum(nil)
+  hexStr := hex.EncodeToString(hashBytes)
+  return hexStr, nil
+}
@@ -0,0 +1,107 @@
+package hashing
+
+import (
+  "context"
+  "fmt"
+  "io/ioutil"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+// generateTree creates files of the given size spread over nested dirs
+func generateTree(b *testing.B, root string, count, size int) {
+  rnd := rand.New(rand.NewSource(1))
+  data := make([]byte, size)
+
+  for i := 0; i < count; i++ {
+    dir := filepath.Join(root, fmt.Sprintf("dir%v", i % 10), fmt.Sprintf("sub%v", i % 7))
+    if err := os.MkdirAll(dir, 0755); err != nil {
+      b.Fatal(err)
+    }
+
+    rnd.Read(data)
+    if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%v.bin", i)), data, 0644); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+// goroutinePerFileHashes hashes files the way it was done before the
+// worker pool: every file gets its own goroutine as soon as it is found
+func goroutinePerFileHashes(root string) (map[string]string, error) {
+  var wg sync.WaitGroup
+  var mutex sync.Mutex
+  var firstErr error
+  m := make(map[string]string)
+
+  err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+    if err != nil || !info.Mode().IsRegular() {
+      return err
+    }
+
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      hash, err := CalculateFileHash(path)
+      key, _ := filepath.Rel(root, path)
+
+      mutex.Lock()
+      defer mutex.Unlock()
+      if err != nil && firstErr == nil {
+        firstErr = err
+      }
+
+      m[filepath.ToSlash(key)] = hash
+    }()
+
+    return nil
+  })
+
+  wg.Wait()
+
+  if err == nil {
+    err = firstErr
+  }
+
+  return m, err
+}
+
+func BenchmarkCalculateHashes(b *testing.B) {
+  root := b.TempDir()
+  generateTree(b, root, 1000, 16 * 1024)
+
+  for _, concurrency := range []int{1, 4, 16} {
+    b.Run(fmt.Sprintf("concurrency-%v", concurrency), func(b *testing.B) {
+      pool := fsutil.NewWorkerPool(concurrency)
+      b.ResetTimer()
+
+      for i := 0; i < b.N; i++ {
+        hashes, err := CalculateHashes(context.Background(), fsutil.OS, root, pool)
+        if err != nil {
+          b.Fatal(err)
+        }
+
+        if len(hashes) != 1000 {
+          b.Fatalf("%v hashes calculated instead of 1000", len(hashes))
+        }
+      }
+    })
+  }
+
+  b.Run("goroutine-per-file", func(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+      hashes, err := goroutinePerFileHashes(root)
+      if err != nil {
+        b.Fatal(err)
+      }
+
+      if len(hashes) != 1000 {
+        b.Fatalf("%v hashes calculated instead of 1000", len(hashes))
+      }
+    }
+  })
+}
@@ -0,0 +1,17 @@
+package hashing
+
+import (
+  "io/ioutil"
+  "log"
+  "os"
+  "testing"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+func TestMain(m *testing.M) {
+  // only test failures are printed
+  log.SetOutput(ioutil.Discard)
+  logging.SetDefault(logging.New(ioutil.Discard, logging.ErrorLevel, logging.TextFormat))
+
+  os.Exit(m.Run())
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+  "context"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/hashing"
+  "github.com/ribtoks/ministaller/src/logging"
+  "github.com/ribtoks/ministaller/src/ministaller"
+)
+
+// statuses of the install report besides install results
+const (
+  // install did not start, e.g. the package was not found
+  installResultFailed = "failed"
+  installResultLocked = "locked"
+)
+
+func runInstall(ctx context.Context, cancel context.CancelFunc) (exitCode int) {
+  metadataPolicy := fsutil.NewMetadataPolicy(preserveOwnerFlag, applyUmaskFlag)
+
+  report := ministaller.NewInstallReport(installPathFlag)
+  report.FromVersion = installedVersion()
+  defer func() {
+    saveReport(report, exitCode)
+  }()
+
+  installLock, err := ministaller.AcquireInstallLock(installPathFlag, lockWaitFlag)
+  if err == ministaller.ErrInstallLocked {
+    log.Println(err)
+    return exitCodeLocked
+  } else if err != nil {
+    logging.WithError(err).Errorf("Failed to lock install dir")
+    report.AddError(err)
+    return exitCodeFailure
+  }
+
+  defer installLock.Release()
+
+  installDirPath := filepath.ToSlash(installPathFlag)
+  log.Printf("Using %v for install path", installDirPath)
+
+  // previous installer could have been killed in the middle
+  if _, err := ministaller.RollbackInterruptedInstall(fsutil.OS, installDirPath); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: "recovery", logging.FieldError: err}).Errorf("Failed to roll back interrupted install")
+    report.AddError(err)
+    return recoveryExitCode(err)
+  }
+
+  // files renamed aside by previous installs are not diffed and
+  // should be removed before preflight checks whether files are in use
+  ministaller.NewInUseStrategy(installDirPath).Cleanup(fsutil.OS)
+
+  pp, err := preparePackage(ctx, metadataPolicy)
+  defer pp.remove()
+  report.Package = packageSource(pp)
+
+  if ctx.Err() != nil {
+    log.Println("Package preparation cancelled")
+    return exitCodeCancelled
+  }
+
+  if err != nil {
+    logging.WithError(err).Errorf("Failed to prepare package")
+    report.AddError(err)
+    return exitCodeFailure
+  }
+
+  report.ToVersion = pp.manifest.Version
+
+  launchOptions := mergeLaunchOptions(pp.manifest.Launch)
+
+  df := ministaller.NewDiffGenerator(ministaller.DiffOptions{
+    InstallDir: installDirPath,
+    PackageDir: pp.dir,
+    KeepMissing: keepMissingFlag,
+    ForceUpdate: forceUpdateFlag,
+    Concurrency: concurrencyFlag,
+    Metadata: metadataPolicy,
+  })
+
+  err = df.GenerateDiffs(ctx)
+  if ctx.Err() != nil {
+    log.Println("Diff generation cancelled")
+    return exitCodeCancelled
+  }
+
+  if err != nil {
+    logging.WithError(err).Errorf("Failed to generate differences")
+    report.AddError(err)
+    return exitCodeFailure
+  }
+
+  var progressHandler ministaller.StatsProgressHandler = &ministaller.LogProgressHandler{}
+
+  if showUIFlag {
+    progressHandler = NewUIProgressHandler()
+  } else if showProgressFlag {
+    progressHandler = ministaller.NewTerminalProgressHandler(os.Stdout)
+  }
+
+  pi := ministaller.NewPackageInstaller(ministaller.InstallOptions{
+    InstallDir: installDirPath,
+    PackageDir: pp.dir,
+    Reporter: ministaller.NewProgressReporter(progressHandler),
+    CopyConcurrency: copyConcurrencyFlag,
+    CriticalFiles: criticalFiles(launchOptions.Exe),
+    Hooks: &pp.manifest.Hooks,
+    Metadata: metadataPolicy,
+    SelfPath: currentExeFullPath,
+    Report: report,
+  })
+
+  defer pi.RemoveSelfIfNeeded()
+
+  exitCode = exitCodeFailure
+
+  if showUIFlag {
+    defer func() {
+      if r := recover(); r != nil {
+        guifinish()
+      }
+    }()  
+    
+    installDone := make(chan bool)
+
+    guiinit(cancel)
+    go func() {
+      exitCode = doInstall(ctx, pi, df, installDirPath, launchOptions, report)
+      installDone <- true
+    }()
+    guiloop()
+    <- installDone
+  } else {
+    exitCode = doInstall(ctx, pi, df, installDirPath, launchOptions, report)
+  }
+
+  return exitCode
+}
+
+func doInstall(ctx context.Context, pi *ministaller.PackageInstaller, df *ministaller.DiffGenerator, installDirPath string, launchOptions *ministaller.LaunchOptions, report *ministaller.InstallReport) int {
+  err := pi.Install(ctx, df)
+
+  result := &ministaller.InstallResult{Version: report.ToVersion}
+  exitCode := exitCodeSuccess
+
+  if err == nil {
+    log.Println("Install succeeded")
+    result.Status = ministaller.InstallResultSuccess
+    saveInstallState(installDirPath, report)
+  } else if _, ok := err.(*ministaller.RollbackError); ok {
+    logging.WithError(err).Errorf("Install failed and rollback is incomplete")
+    result.Status = ministaller.InstallResultRollbackIncomplete
+    exitCode = exitCodeRollbackIncomplete
+  } else if ctx.Err() != nil {
+    logging.WithError(err).Warnf("Install cancelled")
+    result.Status = ministaller.InstallResultCancelled
+    exitCode = exitCodeCancelled
+  } else if _, ok := err.(*ministaller.PreflightError); ok {
+    logging.WithError(err).Warnf("Install aborted")
+    result.Status = ministaller.InstallResultAborted
+    exitCode = exitCodeAborted
+  } else {
+    logging.WithError(err).Errorf("Install failed")
+    result.Status = ministaller.InstallResultRolledBack
+    exitCode = exitCodeFailure
+  }
+
+  report.Status = result.Status
+
+  if len(launchOptions.Exe) > 0 {
+    ministaller.LaunchPostInstallExe(launchOptions, installDirPath, result)
+  }
+
+  return exitCode
+}
+
+// installedVersion reads the version from the state of the install dir,
+// installs made before the state was kept are looked up in reports
+func installedVersion() string {
+  if state, err := ministaller.LoadInstallState(installPathFlag); err == nil && len(state.Version) > 0 {
+    return state.Version
+  }
+
+  return ministaller.InstalledVersion(stateDirFlag, installPathFlag)
+}
+
+// saveInstallState records installed version and package in the install dir
+func saveInstallState(installDirPath string, report *ministaller.InstallReport) {
+  state, err := ministaller.LoadInstallState(installDirPath)
+  if err != nil {
+    state = &ministaller.InstallState{}
+  }
+
+  state.Version = report.ToVersion
+  state.PackageHash = report.Package.Hash
+  now := time.Now()
+  state.InstalledAt = &now
+
+  if err = state.Save(installDirPath); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: installDirPath, logging.FieldError: err}).Warnf("Failed to save install state")
+  }
+}
+
+// recoveryExitCode tells whether failed recovery of the interrupted
+// install left the install dir partially reverted
+func recoveryExitCode(err error) int {
+  if _, ok := err.(*ministaller.RollbackError); ok {
+    return exitCodeRollbackIncomplete
+  }
+
+  return exitCodeFailure
+}
+
+// packageSource describes the package for the install report
+func packageSource(pp *preparedPackage) ministaller.ReportPackage {
+  source := ministaller.ReportPackage{Source: pp.archivePath}
+
+  if len(urlFlag) > 0 && pp.archivePath != packagePathFlag {
+    // hash of the download was checked already
+    source.Source = urlFlag
+    source.Hash = hashFlag
+  } else if hash, err := hashing.CalculateFileHash(pp.archivePath); err == nil {
+    source.Hash = hash
+  }
+
+  return source
+}
+
+// saveReport writes the install report to -report path
+// and keeps it in the state dir
+func saveReport(report *ministaller.InstallReport, exitCode int) {
+  status := report.Status
+  if len(status) == 0 {
+    status = installResultFailed
+    if exitCode == exitCodeCancelled {
+      status = ministaller.InstallResultCancelled
+    } else if exitCode == exitCodeLocked {
+      status = installResultLocked
+    } else if exitCode == exitCodeRollbackIncomplete {
+      status = ministaller.InstallResultRollbackIncomplete
+    }
+  }
+
+  report.Finish(status, exitCode)
+
+  if len(reportPathFlag) > 0 {
+    if err := report.Save(reportPathFlag); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldPath: reportPathFlag, logging.FieldError: err}).Errorf("Failed to save install report")
+    } else {
+      log.Printf("Install report saved to %v", reportPathFlag)
+    }
+  }
+
+  if len(stateDirFlag) > 0 && keepReportsFlag > 0 {
+    if fullpath, err := report.SaveToStateDir(stateDirFlag, keepReportsFlag); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldPath: stateDirFlag, logging.FieldError: err}).Errorf("Failed to keep install report")
+    } else {
+      log.Printf("Install report kept as %v", fullpath)
+    }
+  }
+}
+
+// mergeLaunchOptions combines launch options from the package
+// with the ones from command line which have priority
+func mergeLaunchOptions(packageOptions *ministaller.LaunchOptions) *ministaller.LaunchOptions {
+  options := &ministaller.LaunchOptions{}
+  if packageOptions != nil {
+    *options = *packageOptions
+  }
+
+  if len(launchExeFlag) > 0 { options.Exe = launchExeFlag }
+  if len(launchDirFlag) > 0 { options.WorkDir = launchDirFlag }
+  if len(launchArgsFlag) > 0 { options.Args = launchArgsFlag }
+
+  if len(launchEnvFlag) > 0 {
+    env := make(map[string]string)
+    for key, value := range options.Env {
+      env[key] = value
+    }
+
+    for _, kv := range launchEnvFlag {
+      parts := strings.SplitN(kv, "=", 2)
+      if len(parts) == 2 {
+        env[parts[0]] = parts[1]
+      } else {
+        log.Printf("Ignoring malformed launch env %v", kv)
+      }
+    }
+
+    options.Env = env
+  }
+
+  if isFlagPassed("launch-detach") || options.Detach == nil {
+    detach := launchDetachFlag
+    options.Detach = &detach
+  }
+
+  return options
+}
+
+// criticalFiles returns relative paths of files which have to be replaced
+// only after everything else is in place: the ones passed via flags
+// and the exe launched after install. The installer itself is added
+// by PackageInstaller
+func criticalFiles(launchExe string) []string {
+  files := make([]string, 0)
+
+  for _, relpath := range strings.Split(criticalFilesFlag, ",") {
+    relpath = strings.TrimSpace(relpath)
+    if len(relpath) > 0 {
+      files = append(files, relpath)
+    }
+  }
+
+  if len(launchExe) > 0 {
+    files = append(files, launchExe)
+  }
+
+  return files
+}
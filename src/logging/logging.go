@@ -0,0 +1,276 @@
+// Package logging implements leveled logging with fields in text or JSON
+// format. Lines written via standard log package are bridged into it
+// so they are filtered and formatted the same way
+package logging
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+type Level int
+
+const (
+  DebugLevel Level = iota
+  InfoLevel
+  WarnLevel
+  ErrorLevel
+)
+
+// formats of the output
+const (
+  TextFormat = "text"
+  JSONFormat = "json"
+)
+
+// common field names, support tooling relies on them
+const (
+  FieldStage = "stage"
+  FieldPath = "path"
+  FieldOp = "op"
+  FieldError = "error"
+)
+
+const (
+  textTimeLayout = "2006/01/02 15:04:05"
+)
+
+func (l Level) String() string {
+  switch l {
+  case DebugLevel: return "debug"
+  case InfoLevel: return "info"
+  case WarnLevel: return "warn"
+  case ErrorLevel: return "error"
+  }
+
+  return "unknown"
+}
+
+// ParseLevel converts level name (debug, info, warn or error) to Level
+func ParseLevel(name string) (Level, error) {
+  switch strings.ToLower(name) {
+  case "debug": return DebugLevel, nil
+  case "info": return InfoLevel, nil
+  case "warn", "warning": return WarnLevel, nil
+  case "error": return ErrorLevel, nil
+  }
+
+  return InfoLevel, fmt.Errorf("unknown log level %v", name)
+}
+
+// Fields are key-value pairs attached to the log record
+type Fields map[string]interface{}
+
+type Logger struct {
+  mutex sync.Mutex
+  out io.Writer
+  level Level
+  json bool
+}
+
+// New creates logger writing records of level and above to out
+func New(out io.Writer, level Level, format string) *Logger {
+  return &Logger{
+    out: out,
+    level: level,
+    json: format == JSONFormat,
+  }
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+  defaultLogger.Store(New(os.Stderr, InfoLevel, TextFormat))
+}
+
+// Default returns logger used by package level functions
+func Default() *Logger {
+  return defaultLogger.Load().(*Logger)
+}
+
+// SetDefault replaces logger used by package level functions
+func SetDefault(l *Logger) {
+  defaultLogger.Store(l)
+}
+
+func (l *Logger) Enabled(level Level) bool {
+  return level >= l.level
+}
+
+func (l *Logger) WithFields(fields Fields) *Entry {
+  return (&Entry{logger: l}).WithFields(fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields Fields) {
+  if !l.Enabled(level) {
+    return
+  }
+
+  var line []byte
+  if l.json {
+    line = formatJSON(time.Now(), level, msg, fields)
+  } else {
+    line = formatText(time.Now(), level, msg, fields)
+  }
+
+  l.mutex.Lock()
+  defer l.mutex.Unlock()
+  l.out.Write(line)
+}
+
+func sortedKeys(fields Fields) []string {
+  keys := make([]string, 0, len(fields))
+  for key := range fields {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+  return keys
+}
+
+func fieldValue(value interface{}) interface{} {
+  if err, ok := value.(error); ok {
+    return err.Error()
+  }
+
+  return value
+}
+
+func formatText(t time.Time, level Level, msg string, fields Fields) []byte {
+  var buf bytes.Buffer
+  buf.WriteString(t.Format(textTimeLayout))
+  buf.WriteString(" ")
+  buf.WriteString(strings.ToUpper(level.String()))
+  buf.WriteString(" ")
+  buf.WriteString(msg)
+
+  for _, key := range sortedKeys(fields) {
+    value := fmt.Sprint(fieldValue(fields[key]))
+    if len(value) == 0 || strings.ContainsAny(value, " \t\n\"=") {
+      value = fmt.Sprintf("%q", value)
+    }
+
+    fmt.Fprintf(&buf, " %v=%v", key, value)
+  }
+
+  buf.WriteString("\n")
+  return buf.Bytes()
+}
+
+func formatJSON(t time.Time, level Level, msg string, fields Fields) []byte {
+  var buf bytes.Buffer
+  writePair := func(key string, value interface{}) {
+    encodedKey, _ := json.Marshal(key)
+    encodedValue, err := json.Marshal(value)
+    if err != nil {
+      encodedValue, _ = json.Marshal(fmt.Sprint(value))
+    }
+
+    buf.Write(encodedKey)
+    buf.WriteString(":")
+    buf.Write(encodedValue)
+  }
+
+  buf.WriteString("{")
+  writePair("time", t.Format(time.RFC3339Nano))
+  buf.WriteString(",")
+  writePair("level", level.String())
+  buf.WriteString(",")
+  writePair("msg", msg)
+
+  for _, key := range sortedKeys(fields) {
+    buf.WriteString(",")
+    writePair(key, fieldValue(fields[key]))
+  }
+
+  buf.WriteString("}\n")
+  return buf.Bytes()
+}
+
+// Writer returns writer which logs every line written to it with level.
+// It is used to bridge standard log package
+func (l *Logger) Writer(level Level) io.Writer {
+  return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+  logger *Logger
+  level Level
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+  for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+    lw.logger.log(lw.level, line, nil)
+  }
+
+  return len(p), nil
+}
+
+// Entry is the log record being built with fields
+type Entry struct {
+  logger *Logger
+  fields Fields
+}
+
+func (e *Entry) WithFields(fields Fields) *Entry {
+  merged := make(Fields, len(e.fields) + len(fields))
+  for key, value := range e.fields {
+    merged[key] = value
+  }
+
+  for key, value := range fields {
+    merged[key] = value
+  }
+
+  return &Entry{logger: e.logger, fields: merged}
+}
+
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+  return e.WithFields(Fields{key: value})
+}
+
+func (e *Entry) WithError(err error) *Entry {
+  return e.WithField(FieldError, err)
+}
+
+func (e *Entry) Debugf(format string, args ...interface{}) { e.logf(DebugLevel, format, args...) }
+func (e *Entry) Infof(format string, args ...interface{}) { e.logf(InfoLevel, format, args...) }
+func (e *Entry) Warnf(format string, args ...interface{}) { e.logf(WarnLevel, format, args...) }
+func (e *Entry) Errorf(format string, args ...interface{}) { e.logf(ErrorLevel, format, args...) }
+
+func (e *Entry) logf(level Level, format string, args ...interface{}) {
+  logger := e.logger
+  if logger == nil {
+    logger = Default()
+  }
+
+  if logger.Enabled(level) {
+    logger.log(level, fmt.Sprintf(format, args...), e.fields)
+  }
+}
+
+// WithFields starts the record of the default logger
+func WithFields(fields Fields) *Entry {
+  return (&Entry{}).WithFields(fields)
+}
+
+func WithField(key string, value interface{}) *Entry {
+  return WithFields(Fields{key: value})
+}
+
+func WithError(err error) *Entry {
+  return WithField(FieldError, err)
+}
+
+func Debugf(format string, args ...interface{}) { (&Entry{}).logf(DebugLevel, format, args...) }
+func Infof(format string, args ...interface{}) { (&Entry{}).logf(InfoLevel, format, args...) }
+func Warnf(format string, args ...interface{}) { (&Entry{}).logf(WarnLevel, format, args...) }
+func Errorf(format string, args ...interface{}) { (&Entry{}).logf(ErrorLevel, format, args...) }
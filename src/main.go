@@ -1,6 +1,8 @@
 package main
 
 import (
+  "context"
+  "fmt"
   "log"
   "flag"
   "os"
@@ -8,162 +10,496 @@ import (
   "errors"
   "path"
   "path/filepath"
+  "strings"
+  "time"
   "io/ioutil"
-  "os/exec"
   "net/http"
+  "os/signal"
+  "syscall"
   "gopkg.in/natefinch/lumberjack.v2"
+  "github.com/ribtoks/ministaller/src/archive"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/hashing"
+  "github.com/ribtoks/ministaller/src/logging"
+  "github.com/ribtoks/ministaller/src/ministaller"
 )
 
-// flags
+// flags, each command registers the groups it needs
 var (
-  installPathFlag = flag.String("install-path", "", "Path to the existing installation")
-  packagePathFlag = flag.String("package-path", "", "Path to package with updates")
-  forceUpdateFlag = flag.Bool("force-update", false, "Overwrite same files")
-  keepMissingFlag = flag.Bool("keep-missing", false, "Keep files not found in the update package")
-  logPathFlag = flag.String("l", "ministaller.log", "absolute path to log file")
-  launchExeFlag = flag.String("launch-exe", "", "relative path to exe to launch after install")
-  failFlag = flag.Bool("fail", false, "Fail after install to test rollback")
-  stdoutFlag = flag.Bool("stdout", false, "Log to stdout and to logfile")
-  urlFlag = flag.String("url", "", "Url to the package")
-  hashFlag = flag.String("hash", "", "Hash of the downloaded file to check")
-  showUIFlag = flag.Bool("gui", false, "Show simple progress GUI")
+  configPathFlag string
+  logPathFlag string
+  stdoutFlag bool
+  logLevelFlag string
+  logFormatFlag string
+  logMaxSizeFlag int
+  logMaxBackupsFlag int
+  logMaxAgeFlag int
+
+  installPathFlag string
+  lockWaitFlag time.Duration
+
+  packagePathFlag string
+  urlFlag string
+  hashFlag string
+  downloadLimitFlag int
+  preserveOwnerFlag bool
+  applyUmaskFlag bool
+
+  forceUpdateFlag bool
+  keepMissingFlag bool
+  concurrencyFlag int
+
+  launchExeFlag string
+  launchDirFlag string
+  launchDetachFlag bool
+  launchArgsFlag stringsFlag
+  launchEnvFlag stringsFlag
+  showUIFlag bool
+  showProgressFlag bool
+  copyConcurrencyFlag int
+  criticalFilesFlag string
+
+  outputFlag string
+  sourceDirFlag string
+
+  reportPathFlag string
+  stateDirFlag string
+  keepReportsFlag int
+  cacheKeepFlag int
+  cacheMaxAgeFlag time.Duration
+
+  feedFlag string
+  watchIntervalFlag time.Duration
+  watchJitterFlag time.Duration
+  applyWindowFlag string
+  appExeFlag string
+  onceFlag bool
+  channelFlag string
 )
 
 var (
   currentExeFullPath string
+  // flags of the running command
+  commandFlags *flag.FlagSet
 )
 
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+  return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+  *s = append(*s, value)
+  return nil
+}
+
 const (
   appName = "ministaller"
   downloadRetryCount = 3
+  defaultCommand = "install"
 )
 
+// exit codes
+const (
+  exitCodeSuccess = 0
+  exitCodeFailure = 1
+  exitCodeUsage = 2
+  exitCodeLocked = 3
+  exitCodeCancelled = 4
+  exitCodeAborted = 5
+  exitCodeUpdateAvailable = 6
+  exitCodeRollbackIncomplete = 7
+)
+
+type command struct {
+  name string
+  description string
+  addFlags func(fs *flag.FlagSet)
+  validate func() error
+  run func(ctx context.Context, cancel context.CancelFunc) int
+}
+
+var commands []*command
+
+func init() {
+  commands = []*command{
+    {"install", "Install the package into the install dir (default)", addInstallCommandFlags, validateDiff, runInstall},
+    {"check", "Check whether the install dir differs from the package", addDiffCommandFlags, validateDiff, runCheck},
+    {"download", "Download the package, check its hash and keep it for apply", addDownloadFlags, validateDownload, runDownload},
+    {"apply", "Install the package downloaded before without network access", addApplyFlags, validateApply, runApply},
+    {"diff", "Print changes the install would make as JSON", addDiffCommandFlags, validateDiff, runDiff},
+    {"verify", "Check hash and contents of the package", addVerifyFlags, validatePackage, runVerify},
+    {"rollback", "Roll back the install which was interrupted", addRollbackFlags, validateInstallPath, runRollback},
+    {"build", "Build the package from a directory", addBuildFlags, validateBuild, runBuild},
+    {"watch", "Periodically check the feed, download and install updates", addWatchFlags, validateWatch, runWatch},
+  }
+}
+
+func addCommonFlags(fs *flag.FlagSet) {
+  fs.StringVar(&configPathFlag, "config", "", "Path to JSON or TOML config file with default values of flags")
+  fs.StringVar(&logPathFlag, "l", "ministaller.log", "absolute path to log file")
+  fs.BoolVar(&stdoutFlag, "stdout", false, "Log to stdout and to logfile")
+  fs.StringVar(&logLevelFlag, "log-level", "info", "Minimal level of logged messages: debug, info, warn or error")
+  fs.StringVar(&logFormatFlag, "log-format", logging.TextFormat, "Format of the log: text or json")
+  fs.IntVar(&logMaxSizeFlag, "log-max-size", 10, "Max size of the log file in megabytes before it is rotated")
+  fs.IntVar(&logMaxBackupsFlag, "log-max-backups", 3, "Max number of rotated log files to keep")
+  fs.IntVar(&logMaxAgeFlag, "log-max-age", 28, "Max number of days to keep rotated log files")
+}
+
+func addInstallPathFlags(fs *flag.FlagSet) {
+  fs.StringVar(&installPathFlag, "install-path", "", "Path to the existing installation")
+}
+
+func addLockFlags(fs *flag.FlagSet) {
+  fs.DurationVar(&lockWaitFlag, "lock-wait", 0, "How long to wait for another install to finish (e.g. 30s)")
+}
+
+func addPackageFlags(fs *flag.FlagSet) {
+  fs.StringVar(&packagePathFlag, "package-path", "", "Path to package with updates")
+  fs.StringVar(&urlFlag, "url", "", "Url to the package")
+  fs.StringVar(&hashFlag, "hash", "", "Hash of the downloaded file to check")
+  addDownloadLimitFlags(fs)
+  addStateDirFlags(fs)
+  addMetadataFlags(fs)
+}
+
+func addStateDirFlags(fs *flag.FlagSet) {
+  fs.StringVar(&stateDirFlag, "state-dir", defaultStateDir(), "Directory to keep reports of last installs and downloaded packages in")
+}
+
+func addCacheFlags(fs *flag.FlagSet) {
+  fs.IntVar(&cacheKeepFlag, "cache-keep", 3, "Number of most recently used downloaded packages to keep in state dir")
+  fs.DurationVar(&cacheMaxAgeFlag, "cache-max-age", 30 * 24 * time.Hour, "Remove downloaded packages not used for this long (0 to keep)")
+}
+
+func addDownloadLimitFlags(fs *flag.FlagSet) {
+  fs.IntVar(&downloadLimitFlag, "download-limit", 0, "Max download speed in KB/s (0 for no limit)")
+}
+
+func addMetadataFlags(fs *flag.FlagSet) {
+  fs.BoolVar(&preserveOwnerFlag, "preserve-owner", false, "Preserve uid/gid of files from the package (Unix only)")
+  fs.BoolVar(&applyUmaskFlag, "umask", true, "Apply process umask to permissions from the package (Unix only)")
+}
+
+func addDiffFlags(fs *flag.FlagSet) {
+  fs.BoolVar(&forceUpdateFlag, "force-update", false, "Overwrite same files")
+  fs.BoolVar(&keepMissingFlag, "keep-missing", false, "Keep files not found in the update package")
+  fs.IntVar(&concurrencyFlag, "concurrency", 0, "Max number of files processed in parallel (0 to detect)")
+}
+
+func addInstallCommandFlags(fs *flag.FlagSet) {
+  addInstallPathFlags(fs)
+  addLockFlags(fs)
+  addPackageFlags(fs)
+  addDiffFlags(fs)
+  addInstallerFlags(fs)
+}
+
+// addInstallerFlags adds flags of the install itself
+func addInstallerFlags(fs *flag.FlagSet) {
+  fs.StringVar(&launchExeFlag, "launch-exe", "", "relative path to exe to launch after install")
+  fs.StringVar(&launchDirFlag, "launch-dir", "", "Working directory of the launched exe (relative to install path)")
+  fs.BoolVar(&launchDetachFlag, "launch-detach", true, "Detach the launched exe instead of waiting for it to exit")
+  fs.Var(&launchArgsFlag, "launch-arg", "Argument for the launched exe, can be repeated ({result} and {version} are substituted)")
+  fs.Var(&launchEnvFlag, "launch-env", "KEY=VALUE environment variable for the launched exe, can be repeated")
+  fs.BoolVar(&showUIFlag, "gui", false, "Show simple progress GUI")
+  fs.BoolVar(&showProgressFlag, "progress", false, "Show progress in the terminal")
+  fs.IntVar(&copyConcurrencyFlag, "copy-concurrency", 0, "Max number of files copied in parallel (0 to detect)")
+  fs.StringVar(&criticalFilesFlag, "critical-files", "", "Comma-separated relative paths of files to install last")
+  fs.StringVar(&reportPathFlag, "report", "", "Path to write JSON report of the install to")
+  fs.IntVar(&keepReportsFlag, "keep-reports", 10, "Number of last install reports to keep in state dir (0 to keep none)")
+}
+
+func addDiffCommandFlags(fs *flag.FlagSet) {
+  addInstallPathFlags(fs)
+  addPackageFlags(fs)
+  addDiffFlags(fs)
+  fs.StringVar(&outputFlag, "output", "", "Where to save the diff instead of stdout")
+}
+
+func addDownloadFlags(fs *flag.FlagSet) {
+  fs.StringVar(&urlFlag, "url", "", "Url to the package")
+  fs.StringVar(&hashFlag, "hash", "", "Hash of the downloaded file to check")
+  fs.StringVar(&outputFlag, "output", "", "Where to save the package instead of state dir")
+  addDownloadLimitFlags(fs)
+  addStateDirFlags(fs)
+  addCacheFlags(fs)
+}
+
+func addApplyFlags(fs *flag.FlagSet) {
+  addInstallPathFlags(fs)
+  addLockFlags(fs)
+  fs.StringVar(&hashFlag, "hash", "", "Hash of the downloaded package to install")
+  addStateDirFlags(fs)
+  addCacheFlags(fs)
+  addMetadataFlags(fs)
+  addDiffFlags(fs)
+  addInstallerFlags(fs)
+}
+
+func addVerifyFlags(fs *flag.FlagSet) {
+  addPackageFlags(fs)
+}
+
+func addRollbackFlags(fs *flag.FlagSet) {
+  addInstallPathFlags(fs)
+  addLockFlags(fs)
+}
+
+func addBuildFlags(fs *flag.FlagSet) {
+  fs.StringVar(&sourceDirFlag, "source-dir", "", "Directory with files of the package")
+  fs.StringVar(&outputFlag, "output", "", "Path to the package to create (.zip, .tar, .tar.gz or .tgz)")
+}
+
+func addWatchFlags(fs *flag.FlagSet) {
+  addInstallPathFlags(fs)
+  addLockFlags(fs)
+  addMetadataFlags(fs)
+  addDiffFlags(fs)
+  addInstallerFlags(fs)
+  addDownloadLimitFlags(fs)
+  addStateDirFlags(fs)
+  addCacheFlags(fs)
+  fs.StringVar(&feedFlag, "feed", "", "Url or path of JSON feed with releases")
+  fs.DurationVar(&watchIntervalFlag, "watch-interval", 6 * time.Hour, "How often to check the feed")
+  fs.DurationVar(&watchJitterFlag, "watch-jitter", 30 * time.Minute, "Max random delay added to every check")
+  fs.StringVar(&applyWindowFlag, "apply-window", "", "Local time window to install updates in (e.g. 02:00-05:00)")
+  fs.StringVar(&appExeFlag, "app-exe", "", "Relative path to the application exe, updates are installed only when it is not running")
+  fs.BoolVar(&onceFlag, "once", false, "Check the feed once and exit instead of watching")
+  fs.StringVar(&channelFlag, "channel", ministaller.StableChannel, "Update channel: stable, beta or nightly")
+}
+
 func main() {
-  err := parseFlags()
-  if err != nil {
-    flag.PrintDefaults()
-    log.Fatal(err.Error())
+  os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+  name := defaultCommand
+  // flags without a command mean install for compatibility
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    name, args = args[0], args[1:]
   }
 
-  logfile, err := setupLogging()
-  if err != nil {
-    defer logfile.Close()
+  cmd := findCommand(name)
+  if cmd == nil {
+    fmt.Fprintf(os.Stderr, "Unknown command %v\n", name)
+    printUsage()
+    return exitCodeUsage
   }
 
-  currentExeFullPath = executablePath()
+  currentExeFullPath = fsutil.ExecutablePath()
+
+  err := parseFlags(cmd, args)
+  if err == flag.ErrHelp {
+    return exitCodeSuccess
+  } else if err != nil {
+    return exitCodeUsage
+  }
+
+  logfile := setupLogging()
+  defer logfile.Close()
+
+  log.Printf("Running %v command", cmd.name)
   log.Println("Current exe path is", currentExeFullPath)
 
-  pathToArchive := *packagePathFlag
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  go cancelOnSignal(cancel)
 
-  if len(*urlFlag) > 0 {
-    localPath, err := downloadFile(*urlFlag, downloadRetryCount)
-    if err != nil {
-      log.Fatal(err.Error())
+  return cmd.run(ctx, cancel)
+}
+
+func findCommand(name string) *command {
+  for _, cmd := range commands {
+    if cmd.name == name {
+      return cmd
     }
+  }
+
+  return nil
+}
 
-    defer os.Remove(localPath)
+func printUsage() {
+  fmt.Fprintf(os.Stderr, "Usage: %v <command> [flags]\n\nCommands:\n", appName)
+  for _, cmd := range commands {
+    fmt.Fprintf(os.Stderr, "  %-10v %v\n", cmd.name, cmd.description)
+  }
 
-    hash, err := calculateFileHash(localPath)
-    if err != nil {
-      log.Println(err.Error())
-    } else {
-      if hash != *hashFlag {
-        log.Printf("Hash mismatch! %v expected but %v found", *hashFlag, hash)
-      } else {
-        log.Println("Download succeeded")
-        pathToArchive = localPath
-      }
-    }
+  fmt.Fprintf(os.Stderr, "\nRun '%v <command> -h' for flags of the command\n", appName)
+}
+
+// parseFlags parses command line of the command and fills the rest
+// of the flags from environment and config file
+func parseFlags(cmd *command, args []string) error {
+  commandFlags = flag.NewFlagSet(appName + " " + cmd.name, flag.ContinueOnError)
+  addCommonFlags(commandFlags)
+  cmd.addFlags(commandFlags)
+
+  // flag package reports its own errors with usage
+  if err := commandFlags.Parse(args); err != nil {
+    return err
   }
 
-  packageDirPath, err := ioutil.TempDir("", appName)
+  err := applyConfig(cmd)
   if err != nil {
-    log.Fatal(err)
+    fmt.Fprintln(os.Stderr, err)
+    commandFlags.Usage()
   }
 
-  defer os.RemoveAll(packageDirPath)
+  return err
+}
 
-  err = Unzip(pathToArchive, packageDirPath)
-  if err != nil {
-    log.Fatal(err)
+// applyConfig fills flags which were not passed and validates them
+func applyConfig(cmd *command) error {
+  config := make(Config)
+  if configPath := findConfig(configPathFlag, currentExeFullPath); len(configPath) > 0 {
+    var err error
+    config, err = loadConfig(configPath)
+    if err != nil {
+      return err
+    }
   }
 
-  packageDirPath = findUsefulDir(packageDirPath)
-  packageDirPath = filepath.ToSlash(packageDirPath)
-  log.Printf("Using %v for package path", packageDirPath)
-
-  installDirPath := filepath.ToSlash(*installPathFlag)
-  log.Printf("Using %v for install path", installDirPath)
-
-  df := &DiffGenerator{
-    filesToAdd: make([]*UpdateFileInfo, 0),
-    filesToRemove: make([]*UpdateFileInfo, 0),
-    filesToUpdate: make([]*UpdateFileInfo, 0),
-    filesToAddQueue: make(chan *UpdateFileInfo),
-    filesToRemoveQueue: make(chan *UpdateFileInfo),
-    filesToUpdateQueue: make(chan *UpdateFileInfo),
-    errors: make(chan error, 1),
-    installDirHashes: make(map[string]string),
-    packageDirHashes: make(map[string]string),
-    installDirPath: installDirPath,
-    packageDirPath: packageDirPath,
-    keepMissing: *keepMissingFlag,
-    forceUpdate: *forceUpdateFlag }
-
-  err = df.GenerateDiffs()
-  if err != nil {
-    log.Fatal(err)
+  if err := applyDefaults(commandFlags, cmd.name, config); err != nil {
+    return err
   }
 
-  progressReporter := &ProgressReporter{
-    progressChan: make(chan int64),
-    systemMessageChan: make(chan string),
-    finished: make(chan bool),
-    progressHandler: &LogProgressHandler{},
+  if err := validateLogging(); err != nil {
+    return err
   }
 
-  if *showUIFlag {
-    progressReporter.progressHandler = NewUIProgressHandler()
+  return cmd.validate()
+}
+
+func validateInstallPath() error {
+  installFileInfo, err := os.Stat(installPathFlag)
+  if err != nil { return err }
+  if !installFileInfo.IsDir() { return errors.New("install-path does not point to a directory") }
+
+  return nil
+}
+
+func validatePackage() error {
+  if len(urlFlag) == 0 {
+    packageFileInfo, err := os.Stat(packagePathFlag)
+    if err != nil { return err }
+    if packageFileInfo.IsDir() { return errors.New("package-path should point to a file") }
   }
 
-  go progressReporter.handleProgress()
+  return nil
+}
 
-  pi := &PackageInstaller{
-    backups: make(map[string]string),
-    backupsChan: make(chan BackupPair),
-    progressReporter: progressReporter,
-    installDir: installDirPath,
-    packageDir: packageDirPath,
-    failInTheEnd: *failFlag }
+func validateDiff() error {
+  if err := validateInstallPath(); err != nil {
+    return err
+  }
 
-  defer pi.removeSelfIfNeeded()
+  return validatePackage()
+}
 
-  if *showUIFlag {
-    defer func() {
-      if r := recover(); r != nil {
-        guifinish()
-      }
-    }()  
-    
-    guiinit()
-    go doInstall(pi, df)
-    guiloop()
-  } else {
-    doInstall(pi, df)
+// defaultStateDir returns per-user directory of the installer
+func defaultStateDir() string {
+  dir, err := os.UserConfigDir()
+  if err != nil {
+    return ""
+  }
+
+  return filepath.Join(dir, appName)
+}
+
+func isFlagPassed(name string) bool {
+  passed := false
+  commandFlags.Visit(func(f *flag.Flag) {
+    if f.Name == name {
+      passed = true
+    }
+  })
+
+  return passed
+}
+
+// cancelOnSignal cancels the install on Ctrl+C or termination request
+// so it is stopped at a safe point and rolled back
+func cancelOnSignal(cancel context.CancelFunc) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+  sig := <- signals
+  log.Printf("Received %v, cancelling...", sig)
+  cancel()
+}
+
+// preparedPackage is the package downloaded if needed and extracted
+type preparedPackage struct {
+  archivePath string
+  dir string
+  manifest *ministaller.PackageManifest
+  cleanup []func()
+}
+
+func (pp *preparedPackage) remove() {
+  for i := len(pp.cleanup) - 1; i >= 0; i-- {
+    pp.cleanup[i]()
   }
 }
 
-func doInstall(pi *PackageInstaller, df *DiffGenerator) {
-  err := pi.Install(df)
+// preparePackage downloads the package if url is passed and extracts it
+func preparePackage(ctx context.Context, metadataPolicy *fsutil.MetadataPolicy) (*preparedPackage, error) {
+  pp := &preparedPackage{archivePath: packagePathFlag}
 
-  if err == nil {
-    log.Println("Install succeeded")
-    if len(*launchExeFlag) > 0 {
-      launchPostInstallExe()
+  cachedPath, cached := "", false
+  if len(urlFlag) > 0 && len(stateDirFlag) > 0 {
+    cachedPath, cached = ministaller.NewPackageCache(stateDirFlag).Lookup(hashFlag)
+  }
+
+  if cached {
+    log.Printf("Using downloaded package %v", cachedPath)
+    pp.archivePath = cachedPath
+  } else if len(urlFlag) > 0 {
+    localPath, err := downloadFile(ctx, urlFlag, downloadRetryCount)
+    if err != nil {
+      return pp, err
     }
-  } else {
-    log.Printf("Install failed: %v", err)
+
+    pp.cleanup = append(pp.cleanup, func() { os.Remove(localPath) })
+
+    hash, err := hashing.CalculateFileHash(localPath)
+    if err != nil {
+      logging.WithFields(logging.Fields{logging.FieldPath: localPath, logging.FieldError: err}).Errorf("Failed to hash downloaded file")
+    } else {
+      if hash != hashFlag {
+        logging.WithField(logging.FieldPath, localPath).Errorf("Hash mismatch! %v expected but %v found", hashFlag, hash)
+      } else {
+        log.Println("Download succeeded")
+        pp.archivePath = localPath
+      }
+    }
+  }
+
+  packageDirPath, err := ioutil.TempDir("", appName)
+  if err != nil {
+    return pp, err
+  }
+
+  pp.cleanup = append(pp.cleanup, func() { os.RemoveAll(packageDirPath) })
+
+  err = ministaller.CheckTempSpace(pp.archivePath, packageDirPath)
+  if err != nil {
+    return pp, err
+  }
+
+  err = archive.Extract(ctx, pp.archivePath, packageDirPath, metadataPolicy)
+  if err != nil {
+    return pp, err
   }
+
+  packageDirPath = findUsefulDir(packageDirPath)
+  pp.dir = filepath.ToSlash(packageDirPath)
+  log.Printf("Using %v for package path", pp.dir)
+
+  pp.manifest, err = ministaller.LoadPackageManifest(pp.dir)
+  return pp, err
 }
 
 func findUsefulDir(initialDir string) string {
@@ -182,53 +518,66 @@ func findUsefulDir(initialDir string) string {
   return currDir
 }
 
-func parseFlags() error {
-  flag.Parse()
-
-  installFileInfo, err := os.Stat(*installPathFlag)
-  if os.IsNotExist(err) { return err }
-  if !installFileInfo.IsDir() { return errors.New("install-path does not point to a directory") }
+func validateLogging() error {
+  if _, err := logging.ParseLevel(logLevelFlag); err != nil {
+    return err
+  }
 
-  if len(*urlFlag) == 0 {
-    packageFileInfo, err := os.Stat(*packagePathFlag)
-    if os.IsNotExist(err) { return err }
-    if packageFileInfo.IsDir() { return errors.New("package-path should point to a file") }
+  if logFormatFlag != logging.TextFormat && logFormatFlag != logging.JSONFormat {
+    return fmt.Errorf("unknown log format %v", logFormatFlag)
   }
 
   return nil
 }
 
-func setupLogging() (f *os.File, err error) {
+// setupLogging directs both leveled and standard log to the rotated
+// log file and stdout if requested. Returned file has to be closed
+func setupLogging() io.Closer {
   lgl := &lumberjack.Logger{
-    Filename:   *logPathFlag,
-    MaxSize:    10, // megabytes
-    MaxBackups: 3,
-    MaxAge:     28, //days
+    Filename:   logPathFlag,
+    MaxSize:    logMaxSizeFlag, // megabytes
+    MaxBackups: logMaxBackupsFlag,
+    MaxAge:     logMaxAgeFlag, //days
   }
 
-  if *stdoutFlag {
-    mw := io.MultiWriter(os.Stdout, lgl)
-    log.SetOutput(mw)
-  } else {
-    log.SetOutput(lgl)
+  var out io.Writer = lgl
+  // log lines would break the progress bar
+  if stdoutFlag && !rendersTerminalProgress() {
+    out = io.MultiWriter(os.Stdout, lgl)
   }
-  
-  log.Println("------------------------------")
+
+  // validated while parsing flags
+  level, _ := logging.ParseLevel(logLevelFlag)
+  logger := logging.New(out, level, logFormatFlag)
+  logging.SetDefault(logger)
+
+  log.SetFlags(0)
+  log.SetOutput(logger.Writer(logging.InfoLevel))
+
+  if logFormatFlag == logging.TextFormat {
+    log.Println("------------------------------")
+  }
+
   log.Println("Ministaller log started")
 
-  return f, err
+  return lgl
 }
 
-func downloadFile(remoteAddr string, retryCount int) (string, error) {
+func rendersTerminalProgress() bool {
+  uses := showProgressFlag || (showUIFlag && guiUsesTerminal)
+  return uses && ministaller.IsTerminal(os.Stdout)
+}
+
+func downloadFile(ctx context.Context, remoteAddr string, retryCount int) (string, error) {
   triesCount := 0
 
   for {
-    filepath, err := downloadFileOnce(remoteAddr)
+    filepath, err := downloadFileOnce(ctx, remoteAddr)
 
     if err != nil {
       triesCount++
-      if triesCount >= retryCount {
-        return "", nil
+      if (triesCount >= retryCount) || (ctx.Err() != nil) {
+        return "", err
       } else {
         log.Println("Retrying download...")
       }
@@ -238,20 +587,41 @@ func downloadFile(remoteAddr string, retryCount int) (string, error) {
   }
 }
 
-func downloadFileOnce(remoteAddr string) (filepath string, err error) {
+func downloadFileOnce(ctx context.Context, remoteAddr string) (filepath string, err error) {
   log.Printf("Downloading %v", remoteAddr)
 
+  req, err := http.NewRequest("GET", remoteAddr, nil)
+  if err != nil {
+    return "", err
+  }
+
+  resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "download", logging.FieldPath: remoteAddr, logging.FieldError: err}).Warnf("Download failed")
+    return "", err
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("unexpected response status: %v", resp.Status)
+  }
+
   tempfile, err := ioutil.TempFile("", appName)
   if err != nil {
     return "", err
   }
   defer tempfile.Close()
 
-  resp, err := http.Get(remoteAddr)
-  defer resp.Body.Close()
+  var body io.Reader = resp.Body
+  if downloadLimitFlag > 0 {
+    body = newThrottledReader(ctx, body, int64(downloadLimitFlag) * 1024)
+  }
 
-  n, err := io.Copy(tempfile, resp.Body)
+  n, err := io.Copy(tempfile, body)
   if err != nil {
+    tempfile.Close()
+    os.Remove(tempfile.Name())
     return "", err
   }
 
@@ -260,13 +630,39 @@ func downloadFileOnce(remoteAddr string) (filepath string, err error) {
   return tempfile.Name(), nil
 }
 
-func launchPostInstallExe() {
-  fullpath := path.Join(*installPathFlag, *launchExeFlag)
-  log.Printf("Trying to launch %v", fullpath)
+// throttledReader limits average speed of reading
+type throttledReader struct {
+  ctx context.Context
+  r io.Reader
+  limit int64 // bytes per second
+  start time.Time
+  read int64
+}
 
-  cmd := exec.Command(fullpath, "")
-  err := cmd.Start()
-  if err != nil {
-    log.Println(err)
+func newThrottledReader(ctx context.Context, r io.Reader, limit int64) *throttledReader {
+  return &throttledReader{ctx: ctx, r: r, limit: limit, start: time.Now()}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+  // small reads keep the speed even
+  if int64(len(p)) > tr.limit {
+    p = p[:tr.limit]
+  }
+
+  n, err := tr.r.Read(p)
+  tr.read += int64(n)
+
+  expected := time.Duration(float64(tr.read) / float64(tr.limit) * float64(time.Second))
+  if delay := expected - time.Since(tr.start); delay > 0 {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+    case <- timer.C:
+    case <- tr.ctx.Done():
+      return n, tr.ctx.Err()
+    }
   }
+
+  return n, err
 }
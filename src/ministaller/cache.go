@@ -0,0 +1,201 @@
+package ministaller
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+  "github.com/ribtoks/ministaller/src/hashing"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // name of the cache dir inside of the state dir
+  PackageCacheDirName = "packages"
+)
+
+var (
+  ErrInvalidHash = errors.New("invalid package hash")
+)
+
+// PackageCache keeps verified packages named by their sha1 so
+// they can be installed later without network access
+type PackageCache struct {
+  dir string
+}
+
+func NewPackageCache(stateDir string) *PackageCache {
+  return &PackageCache{dir: filepath.Join(stateDir, PackageCacheDirName)}
+}
+
+func (pc *PackageCache) Dir() string {
+  return pc.dir
+}
+
+// Lookup returns path of the cached package with the hash. The package
+// is verified again and removed if it was damaged
+func (pc *PackageCache) Lookup(hash string) (string, bool) {
+  // feeds can have hashes in upper case
+  hash = strings.ToLower(hash)
+  if !isValidHash(hash) {
+    return "", false
+  }
+
+  matches, _ := filepath.Glob(filepath.Join(pc.dir, hash + ".*"))
+  for _, pkgPath := range matches {
+    if strings.HasSuffix(pkgPath, NewFileExt) {
+      continue
+    }
+
+    actual, err := hashing.CalculateFileHash(pkgPath)
+    if err == nil && actual == hash {
+      // last use time is what garbage collection looks at
+      now := time.Now()
+      os.Chtimes(pkgPath, now, now)
+      return pkgPath, true
+    }
+
+    logging.WithFields(logging.Fields{logging.FieldPath: pkgPath, logging.FieldError: err}).Warnf("Removing damaged cached package")
+    os.Remove(pkgPath)
+  }
+
+  return "", false
+}
+
+// Store verifies the package and copies it to the cache,
+// ext is the archive extension (e.g. .zip or .tar.gz)
+func (pc *PackageCache) Store(srcPath, hash, ext string) (string, error) {
+  hash = strings.ToLower(hash)
+  if !isValidHash(hash) {
+    return "", ErrInvalidHash
+  }
+
+  if pkgPath, ok := pc.Lookup(hash); ok {
+    return pkgPath, nil
+  }
+
+  actual, err := hashing.CalculateFileHash(srcPath)
+  if err != nil {
+    return "", err
+  }
+
+  if actual != hash {
+    return "", fmt.Errorf("hash mismatch: %v expected but %v found", hash, actual)
+  }
+
+  if err = os.MkdirAll(pc.dir, 0755); err != nil {
+    return "", err
+  }
+
+  pkgPath := filepath.Join(pc.dir, hash + ext)
+  // partially copied package should never look complete
+  tmpPath := pkgPath + NewFileExt
+
+  err = copyPackage(srcPath, tmpPath)
+  if err == nil {
+    err = os.Rename(tmpPath, pkgPath)
+  }
+
+  if err != nil {
+    os.Remove(tmpPath)
+    return "", err
+  }
+
+  logging.WithField(logging.FieldPath, pkgPath).Infof("Package is cached")
+  return pkgPath, nil
+}
+
+// GC removes packages which were not used for maxAge and all but keep
+// most recently used ones. Packages with hashes in pinned are kept
+func (pc *PackageCache) GC(keep int, maxAge time.Duration, pinned ...string) error {
+  entries, err := ioutil.ReadDir(pc.dir)
+  if os.IsNotExist(err) {
+    return nil
+  }
+
+  if err != nil {
+    return err
+  }
+
+  // most recently used first
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].ModTime().After(entries[j].ModTime())
+  })
+
+  isPinned := make(map[string]bool)
+  for _, hash := range pinned {
+    isPinned[strings.ToLower(hash)] = true
+  }
+
+  kept := 0
+  for _, fi := range entries {
+    if fi.IsDir() {
+      continue
+    }
+
+    name := fi.Name()
+    age := time.Since(fi.ModTime())
+
+    if strings.HasSuffix(name, NewFileExt) {
+      // the package could be being stored right now
+      if age < time.Hour {
+        continue
+      }
+    } else {
+      hash := strings.SplitN(name, ".", 2)[0]
+      if isPinned[hash] || (kept < keep && (maxAge <= 0 || age <= maxAge)) {
+        kept++
+        continue
+      }
+    }
+
+    entry := logging.WithFields(logging.Fields{logging.FieldOp: "gc", logging.FieldPath: name})
+    if err := os.Remove(filepath.Join(pc.dir, name)); err != nil {
+      entry.WithError(err).Warnf("Failed to remove cached package")
+    } else {
+      entry.Infof("Removed cached package")
+    }
+  }
+
+  return nil
+}
+
+func isValidHash(hash string) bool {
+  if len(hash) == 0 {
+    return false
+  }
+
+  for _, r := range hash {
+    if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+      return false
+    }
+  }
+
+  return true
+}
+
+func copyPackage(src, dst string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  out, err := os.Create(dst)
+  if err != nil {
+    return err
+  }
+
+  if _, err = io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+
+  return out.Close()
+}
@@ -0,0 +1,65 @@
+package ministaller
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+  "github.com/ribtoks/ministaller/src/hashing"
+)
+
+func TestPackageCache(t *testing.T) {
+  tests := []struct {
+    name string
+    // transforms the real hash of the package
+    storeHash func(hash string) string
+    lookupHash func(hash string) string
+    wantStoreErr bool
+    wantFound bool
+  }{
+    {"lower case", strings.ToLower, strings.ToLower, false, true},
+    {"upper case store", strings.ToUpper, strings.ToLower, false, true},
+    {"upper case lookup", strings.ToLower, strings.ToUpper, false, true},
+    {"upper case", strings.ToUpper, strings.ToUpper, false, true},
+    {"wrong hash", func(string) string { return strings.Repeat("A", 40) }, strings.ToLower, true, false},
+    {"invalid hash", func(string) string { return "../package" }, strings.ToLower, true, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      dir := t.TempDir()
+      srcPath := filepath.Join(dir, "package.zip")
+      if err := ioutil.WriteFile(srcPath, []byte("package"), 0644); err != nil {
+        t.Fatal(err)
+      }
+
+      hash, err := hashing.CalculateFileHash(srcPath)
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      pc := NewPackageCache(filepath.Join(dir, "state"))
+
+      pkgPath, err := pc.Store(srcPath, tt.storeHash(hash), ".zip")
+      if (err != nil) != tt.wantStoreErr {
+        t.Fatalf("unexpected store error: %v", err)
+      }
+
+      if err == nil && filepath.Base(pkgPath) != hash + ".zip" {
+        t.Fatalf("package is cached as %v", pkgPath)
+      }
+
+      foundPath, found := pc.Lookup(tt.lookupHash(hash))
+      if found != tt.wantFound || (found && foundPath != pkgPath) {
+        t.Fatalf("lookup returned %v, %v", foundPath, found)
+      }
+
+      // stored again with any case it is found in the cache
+      if found {
+        if again, err := pc.Store(srcPath, strings.ToUpper(hash), ".zip"); err != nil || again != pkgPath {
+          t.Fatalf("package is stored again as %v: %v", again, err)
+        }
+      }
+    })
+  }
+}
@@ -0,0 +1,618 @@
+package ministaller
+
+import (
+  "context"
+  "log"
+  "os"
+  "path/filepath"
+  "runtime"
+  "sort"
+  "sync"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+  "github.com/ribtoks/ministaller/src/hashing"
+)
+
+type UpdateFileInfo struct {
+  Filepath string `json:"path"`
+  Sha1 string `json:"sha1"`
+  FileSize int64 `json:"size"`
+  // hash of the installed file which is updated
+  OldSha1 string `json:"old-sha1,omitempty"`
+  // relative path of unchanged local file with the same contents
+  LocalSource string `json:"local,omitempty"`
+  // target of the symlink, Sha1 is empty for symlinks
+  LinkTarget string `json:"link,omitempty"`
+}
+
+func newUpdateFileInfo(relpath, hash string, size int64) *UpdateFileInfo {
+  ufi := &UpdateFileInfo{
+    Filepath: relpath,
+    Sha1: hash,
+    FileSize: size,
+  }
+
+  if target, ok := fsutil.SymlinkFromHash(hash); ok {
+    ufi.Sha1 = ""
+    ufi.LinkTarget = target
+    ufi.FileSize = 0
+  }
+
+  return ufi
+}
+
+// MoveFileInfo describes a file which only changed its location
+type MoveFileInfo struct {
+  FromPath string `json:"from"`
+  ToPath string `json:"to"`
+  Sha1 string `json:"sha1"`
+  FileSize int64 `json:"size"`
+}
+
+type UpdateFilesProvider interface {
+  FilesToAdd() []*UpdateFileInfo
+  FilesToRemove() []*UpdateFileInfo
+  FilesToUpdate() []*UpdateFileInfo
+  FilesToMove() []*MoveFileInfo
+  DirsToAdd() []*UpdateFileInfo
+  DirsToRemove() []*UpdateFileInfo
+}
+
+type contentKey struct {
+  sha1 string
+  size int64
+}
+
+type ByFilepath []*UpdateFileInfo
+
+func (s ByFilepath) Len() int {
+  return len(s)
+}
+func (s ByFilepath) Swap(i, j int) {
+  s[i], s[j] = s[j], s[i]
+}
+func (s ByFilepath) Less(i, j int) bool {
+  return s[i].Filepath < s[j].Filepath
+}
+
+type DiffGenerator struct {
+  filesToAdd []*UpdateFileInfo
+  filesToRemove []*UpdateFileInfo
+  filesToUpdate []*UpdateFileInfo
+  filesToMove []*MoveFileInfo
+  dirsToAdd []*UpdateFileInfo
+  dirsToRemove []*UpdateFileInfo
+  filesToAddQueue chan *UpdateFileInfo
+  filesToRemoveQueue chan *UpdateFileInfo
+  filesToUpdateQueue chan *UpdateFileInfo
+  errors chan error
+  installDirHashes map[string]string
+  packageDirHashes map[string]string
+  installDirPath string
+  packageDirPath string
+  keepMissing bool
+  forceUpdate bool
+  pool *fsutil.WorkerPool
+  metadataPolicy *fsutil.MetadataPolicy
+  fs fsutil.FS
+  // service files of the installer which are never installed or removed
+  excludedPaths map[string]bool
+}
+
+// DiffOptions configure what DiffGenerator compares
+type DiffOptions struct {
+  InstallDir string
+  PackageDir string
+  // keep files which are not in the package
+  KeepMissing bool
+  // update files even if they are the same
+  ForceUpdate bool
+  // max number of files hashed in parallel, 0 to detect
+  Concurrency int
+  // relative paths which are never installed or removed
+  // in addition to the installer's own files like the lock and journal
+  ExcludedPaths []string
+  Metadata *fsutil.MetadataPolicy
+  // file system with both dirs, the real one if nil
+  FS fsutil.FS
+}
+
+func NewDiffGenerator(options DiffOptions) *DiffGenerator {
+  concurrency := options.Concurrency
+  if concurrency <= 0 {
+    concurrency = fsutil.DefaultConcurrency(options.InstallDir)
+  }
+
+  fsys := options.FS
+  if fsys == nil {
+    fsys = fsutil.OS
+  }
+
+  excludedPaths := map[string]bool{
+    LockFileName: true,
+    JournalFileName: true,
+    PendingFileName: true,
+    StateFileName: true,
+    // left if the installer was killed while saving the state
+    StateFileName + NewFileExt: true,
+  }
+  for _, relpath := range options.ExcludedPaths {
+    excludedPaths[filepath.ToSlash(relpath)] = true
+  }
+
+  return &DiffGenerator{
+    filesToAdd: make([]*UpdateFileInfo, 0),
+    filesToRemove: make([]*UpdateFileInfo, 0),
+    filesToUpdate: make([]*UpdateFileInfo, 0),
+    filesToMove: make([]*MoveFileInfo, 0),
+    dirsToAdd: make([]*UpdateFileInfo, 0),
+    dirsToRemove: make([]*UpdateFileInfo, 0),
+    filesToAddQueue: make(chan *UpdateFileInfo),
+    filesToRemoveQueue: make(chan *UpdateFileInfo),
+    filesToUpdateQueue: make(chan *UpdateFileInfo),
+    errors: make(chan error, 1),
+    installDirHashes: make(map[string]string),
+    packageDirHashes: make(map[string]string),
+    installDirPath: filepath.ToSlash(options.InstallDir),
+    packageDirPath: filepath.ToSlash(options.PackageDir),
+    keepMissing: options.KeepMissing,
+    forceUpdate: options.ForceUpdate,
+    pool: fsutil.NewWorkerPool(concurrency),
+    metadataPolicy: options.Metadata,
+    fs: fsys,
+    excludedPaths: excludedPaths,
+  }
+}
+
+func (df DiffGenerator) FilesToAdd() []*UpdateFileInfo {
+  return df.filesToAdd
+}
+
+func (df DiffGenerator) FilesToUpdate() []*UpdateFileInfo {
+  return df.filesToUpdate
+}
+
+func (df DiffGenerator) FilesToRemove() []*UpdateFileInfo {
+  return df.filesToRemove
+}
+
+func (df DiffGenerator) FilesToMove() []*MoveFileInfo {
+  return df.filesToMove
+}
+
+func (df DiffGenerator) DirsToAdd() []*UpdateFileInfo {
+  return df.dirsToAdd
+}
+
+func (df DiffGenerator) DirsToRemove() []*UpdateFileInfo {
+  return df.dirsToRemove
+}
+
+func (df *DiffGenerator) GenerateDiffs(ctx context.Context) error {
+  err := df.calculateHashes(ctx)
+  if err != nil {
+    return err
+  }
+
+  for _, hashes := range []map[string]string{df.installDirHashes, df.packageDirHashes} {
+    for relpath := range hashes {
+      if df.isExcludedPath(relpath) {
+        delete(hashes, relpath)
+      }
+    }
+  }
+
+  err = df.validatePackageLinks()
+  if err != nil {
+    return err
+  }
+
+  var wg sync.WaitGroup
+
+  wg.Add(1)
+  go func() {
+    for fi := range df.filesToAddQueue {
+      df.filesToAdd = append(df.filesToAdd, fi)
+    }
+
+    log.Printf("Found %v files to add", len(df.filesToAdd))
+    wg.Done()
+  }()
+
+  wg.Add(1)
+  go func() {
+    for fi := range df.filesToRemoveQueue {
+      df.filesToRemove = append(df.filesToRemove, fi)
+    }
+
+    log.Printf("Found %v files to remove", len(df.filesToRemove))
+    wg.Done()
+  }()
+
+  wg.Add(1)
+  go func() {
+    for fi := range df.filesToUpdateQueue {
+      df.filesToUpdate = append(df.filesToUpdate, fi)
+    }
+
+    log.Printf("Found %v files to update", len(df.filesToUpdate))
+    wg.Done()
+  }()
+
+  df.generateDirectoryDiff(ctx, df.installDirPath, df.packageDirPath)
+
+  wg.Wait()
+
+  select {
+  case err = <- df.errors:
+    logging.WithError(err).Errorf("Failed to generate differences")
+    return err
+  default:
+  }
+
+  sort.Sort(ByFilepath(df.filesToAdd))
+  sort.Sort(ByFilepath(df.filesToRemove))
+  sort.Sort(ByFilepath(df.filesToUpdate))
+  sort.Sort(ByFilepath(df.dirsToAdd))
+  sort.Sort(ByFilepath(df.dirsToRemove))
+
+  log.Printf("Found %v directories to add and %v to remove", len(df.dirsToAdd), len(df.dirsToRemove))
+
+  df.detectMoves()
+  df.findLocalSources()
+
+  log.Println("Differences generated")
+
+  return nil
+}
+
+// validatePackageLinks makes sure no symlink in the package
+// points outside of the install dir, alone or through other symlinks
+func (df *DiffGenerator) validatePackageLinks() error {
+  links := make(map[string]string)
+  for relpath, hash := range df.packageDirHashes {
+    if target, ok := fsutil.SymlinkFromHash(hash); ok {
+      links[relpath] = target
+    }
+  }
+
+  if err := fsutil.ValidateLinks(links); err != nil {
+    logging.WithError(err).Errorf("Invalid package")
+    return err
+  }
+
+  return nil
+}
+
+// detectMoves pairs removed and added files with the same contents
+// so they can be renamed inside of the install dir instead of copied
+func (df *DiffGenerator) detectMoves() {
+  removed := make(map[contentKey][]*UpdateFileInfo)
+  for _, fi := range df.filesToRemove {
+    if len(fi.Sha1) == 0 { continue }
+    key := contentKey{fi.Sha1, fi.FileSize}
+    removed[key] = append(removed[key], fi)
+  }
+
+  movedFrom := make(map[string]bool)
+  filesToAdd := make([]*UpdateFileInfo, 0, len(df.filesToAdd))
+
+  for _, fi := range df.filesToAdd {
+    key := contentKey{fi.Sha1, fi.FileSize}
+    candidates := removed[key]
+
+    if len(fi.Sha1) == 0 || len(candidates) == 0 {
+      filesToAdd = append(filesToAdd, fi)
+      continue
+    }
+
+    source := candidates[0]
+    removed[key] = candidates[1:]
+    movedFrom[source.Filepath] = true
+
+    df.filesToMove = append(df.filesToMove, &MoveFileInfo{
+      FromPath: source.Filepath,
+      ToPath: fi.Filepath,
+      Sha1: fi.Sha1,
+      FileSize: fi.FileSize,
+    })
+  }
+
+  filesToRemove := make([]*UpdateFileInfo, 0, len(df.filesToRemove))
+  for _, fi := range df.filesToRemove {
+    if !movedFrom[fi.Filepath] {
+      filesToRemove = append(filesToRemove, fi)
+    }
+  }
+
+  df.filesToAdd = filesToAdd
+  df.filesToRemove = filesToRemove
+
+  log.Printf("Found %v files to move", len(df.filesToMove))
+}
+
+// findLocalSources marks added files which can be copied from
+// a local file that stays untouched during the install
+func (df *DiffGenerator) findLocalSources() {
+  changed := make(map[string]bool)
+  for _, fi := range df.filesToRemove { changed[fi.Filepath] = true }
+  for _, fi := range df.filesToUpdate { changed[fi.Filepath] = true }
+  for _, mi := range df.filesToMove { changed[mi.FromPath] = true }
+
+  local := make(map[string]string)
+  for relpath, hash := range df.installDirHashes {
+    if changed[relpath] { continue }
+    if _, ok := fsutil.SymlinkFromHash(hash); ok { continue }
+
+    if existing, ok := local[hash]; !ok || relpath < existing {
+      local[hash] = relpath
+    }
+  }
+
+  count := 0
+
+  for _, fi := range df.filesToAdd {
+    if len(fi.Sha1) == 0 { continue }
+    relpath, ok := local[fi.Sha1]
+    if !ok { continue }
+
+    lfi, err := df.fs.Stat(filepath.Join(df.installDirPath, relpath))
+    if err != nil || lfi.Size() != fi.FileSize { continue }
+
+    fi.LocalSource = relpath
+    count++
+  }
+
+  log.Printf("Found %v files to add from local copies", count)
+}
+
+func (df *DiffGenerator) calculateHashes(ctx context.Context) error {
+  log.Println("Calculating hashes...")
+  var wg sync.WaitGroup
+  var installErr, packageErr error
+
+  wg.Add(1)
+  go func() {
+    df.installDirHashes, installErr = hashing.CalculateHashes(ctx, df.fs, df.installDirPath, df.pool)
+    wg.Done()
+  }()
+
+  wg.Add(1)
+  go func() {
+    df.packageDirHashes, packageErr = hashing.CalculateHashes(ctx, df.fs, df.packageDirPath, df.pool)
+    wg.Done()
+  }()
+
+  wg.Wait()
+
+  if installErr != nil { return installErr }
+  if packageErr != nil { return packageErr }
+
+  log.Println("Hashes calculated")
+
+  return nil
+}
+
+// permissionsDiffer reports lost or gained executable and other permission bits.
+// Windows has no real permissions so they are never compared there
+func (df *DiffGenerator) permissionsDiffer(installMode, packageMode os.FileMode) bool {
+  if runtime.GOOS == "windows" {
+    return false
+  }
+
+  if fsutil.IsSymlink(installMode) || fsutil.IsSymlink(packageMode) {
+    // type change is caught by hashes and links have no own permissions
+    return false
+  }
+
+  return df.metadataPolicy.Permissions(installMode, false) != df.metadataPolicy.Permissions(packageMode, false)
+}
+
+// reportError keeps only the first error, the rest are just logged
+func (df *DiffGenerator) reportError(err error) {
+  select {
+  case df.errors <- err:
+  default:
+    logging.WithError(err).Warnf("Additional diff error")
+  }
+}
+
+func (df *DiffGenerator) generateDirectoryDiff(ctx context.Context, installDir, packageDir string) {
+  log.Printf("Install dir: %v, packageDir: %v", installDir, packageDir);
+
+  go df.findFilesToRemoveOrUpdate(ctx, installDir, packageDir)
+  go df.findFilesToAdd(ctx, installDir, packageDir)
+}
+
+// isExcluded checks whether path under root is one of the installer's
+// own files or was excluded by the caller, such paths are never diffed
+func (df *DiffGenerator) isExcluded(root, path string) bool {
+  relativePath, err := filepath.Rel(root, path)
+  if err != nil {
+    return false
+  }
+
+  return df.isExcludedPath(filepath.ToSlash(relativePath))
+}
+
+// isExcludedPath checks slash-separated path relative to the install or
+// package dir. Files renamed aside stay until they are not in use anymore
+func (df *DiffGenerator) isExcludedPath(relpath string) bool {
+  return df.excludedPaths[relpath] || isAsideFile(relpath)
+}
+
+// checkDirToRemove is called only from the install dir walker
+func (df *DiffGenerator) checkDirToRemove(path string) error {
+  if df.keepMissing {
+    return nil
+  }
+
+  relativePath, err := filepath.Rel(df.installDirPath, path)
+  if err != nil { return err }
+  relativePath = filepath.ToSlash(relativePath)
+  if relativePath == "." { return nil }
+
+  _, err = df.fs.Lstat(filepath.Join(df.packageDirPath, relativePath))
+  if os.IsNotExist(err) {
+    df.dirsToRemove = append(df.dirsToRemove, &UpdateFileInfo{Filepath: relativePath})
+    return nil
+  }
+
+  return err
+}
+
+// checkDirToAdd is called only from the package dir walker
+func (df *DiffGenerator) checkDirToAdd(path string) error {
+  relativePath, err := filepath.Rel(df.packageDirPath, path)
+  if err != nil { return err }
+  relativePath = filepath.ToSlash(relativePath)
+  if relativePath == "." { return nil }
+
+  _, err = df.fs.Lstat(filepath.Join(df.installDirPath, relativePath))
+  if os.IsNotExist(err) {
+    df.dirsToAdd = append(df.dirsToAdd, &UpdateFileInfo{Filepath: relativePath})
+    return nil
+  }
+
+  return err
+}
+
+func (df *DiffGenerator) findFilesToRemoveOrUpdate(ctx context.Context, installDir, packageDir string) {
+  group := df.pool.NewGroup()
+
+  err := fsutil.Walk(df.fs, installDir, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if err = group.Err(); err != nil {
+      return err
+    }
+
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+
+    if df.isExcluded(df.installDirPath, path) {
+      return nil
+    }
+
+    if info.IsDir() {
+      return df.checkDirToRemove(path)
+    }
+
+    if !fsutil.IsFileOrSymlink(info.Mode()) {
+      return nil
+    }
+
+    installFileSize := info.Size()
+    installFileMode := info.Mode()
+
+    group.Go(func() error {
+      relativePath, err := filepath.Rel(df.installDirPath, path)
+      if err != nil { return err }
+      relativePath = filepath.ToSlash(relativePath)
+      packagePath := filepath.Join(df.packageDirPath, relativePath)
+      installFileHash := df.installDirHashes[relativePath]
+
+      pfi, err := df.fs.Lstat(packagePath)
+      if os.IsNotExist(err) {
+        if !df.keepMissing {
+          df.filesToRemoveQueue <- newUpdateFileInfo(relativePath, installFileHash, installFileSize)
+        }
+      } else if err != nil {
+        return err
+      } else {
+        packageFileHash := df.packageDirHashes[relativePath]
+
+        modeChanged := df.permissionsDiffer(installFileMode, pfi.Mode())
+
+        if (packageFileHash != installFileHash) || modeChanged || (df.forceUpdate) {
+          ufi := newUpdateFileInfo(relativePath, packageFileHash, pfi.Size())
+          if _, isLink := fsutil.SymlinkFromHash(installFileHash); !isLink {
+            ufi.OldSha1 = installFileHash
+          }
+          df.filesToUpdateQueue <- ufi
+        }
+      }
+
+      return nil
+    })
+
+    return nil
+  })
+
+  if werr := group.Wait(); err == nil {
+    err = werr
+  }
+
+  if err != nil {
+    logging.WithError(err).Errorf("Error while update/remove generation")
+    df.reportError(err)
+  }
+
+  close(df.filesToRemoveQueue)
+  close(df.filesToUpdateQueue)
+}
+
+func (df *DiffGenerator) findFilesToAdd(ctx context.Context, installDir, packageDir string) {
+  group := df.pool.NewGroup()
+
+  err := fsutil.Walk(df.fs, packageDir, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if err = group.Err(); err != nil {
+      return err
+    }
+
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+
+    if df.isExcluded(df.packageDirPath, path) {
+      return nil
+    }
+
+    if info.IsDir() {
+      return df.checkDirToAdd(path)
+    }
+
+    if !fsutil.IsFileOrSymlink(info.Mode()) {
+      return nil
+    }
+
+    packageFileSize := info.Size()
+
+    group.Go(func() error {
+      relativePath, err := filepath.Rel(df.packageDirPath, path)
+      if err != nil { return err }
+      relativePath = filepath.ToSlash(relativePath)
+      installPath := filepath.Join(df.installDirPath, relativePath)
+
+      _, err = df.fs.Lstat(installPath)
+      if os.IsNotExist(err) {
+        packageFileHash := df.packageDirHashes[relativePath]
+        df.filesToAddQueue <- newUpdateFileInfo(relativePath, packageFileHash, packageFileSize)
+      } else if err != nil {
+        return err
+      }
+
+      return nil
+    })
+
+    return nil
+  })
+
+  if werr := group.Wait(); err == nil {
+    err = werr
+  }
+
+  if err != nil {
+    logging.WithError(err).Errorf("Error while add generation")
+    df.reportError(err)
+  }
+
+  close(df.filesToAddQueue)
+}
@@ -0,0 +1,139 @@
+package ministaller
+
+import (
+  "context"
+  "fmt"
+  "io/ioutil"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+func TestGenerateDiffsLinks(t *testing.T) {
+  tests := []struct {
+    name string
+    // symlinks in the package
+    links map[string]string
+    wantErr bool
+  }{
+    {"inside", map[string]string{"a": ".", "dir/b": "../a"}, false},
+    {"absolute", map[string]string{"a": "/etc"}, true},
+    {"parent", map[string]string{"dir/a": "../.."}, true},
+    {"parent link chain", map[string]string{"a": ".", "b": "a/.."}, true},
+    {"nested link chain", map[string]string{"dir/a": "..", "b": "dir/a/dir/a/.."}, true},
+    {"loop", map[string]string{"a": "b", "b": "a"}, true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      memfs := fsutil.NewMemFS()
+      memfs.MkdirAll(testInstallDir, fsutil.DefaultDirMode)
+      memfs.MkdirAll(testPackageDir + "/dir", fsutil.DefaultDirMode)
+
+      for relpath, target := range tt.links {
+        if err := memfs.Symlink(target, testPackageDir + "/" + relpath); err != nil {
+          t.Fatal(err)
+        }
+      }
+
+      df := NewDiffGenerator(DiffOptions{
+        InstallDir: testInstallDir,
+        PackageDir: testPackageDir,
+        Concurrency: 1,
+        FS: memfs,
+      })
+
+      err := df.GenerateDiffs(context.Background())
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("unexpected diff error: %v", err)
+      }
+
+      if err != nil && !strings.Contains(err.Error(), fsutil.ErrPathEscapes.Error()) && !strings.Contains(err.Error(), fsutil.ErrSymlinkLoop.Error()) {
+        t.Fatalf("unexpected diff error: %v", err)
+      }
+    })
+  }
+}
+
+// generateTrees creates install and package dirs with count files where
+// every fifth file differs, every tenth is only installed and every
+// tenth is only in the package
+func generateTrees(b *testing.B, count, size int) (installDir, packageDir string) {
+  root := b.TempDir()
+  installDir = filepath.Join(root, "install")
+  packageDir = filepath.Join(root, "package")
+
+  rnd := rand.New(rand.NewSource(1))
+  data := make([]byte, size)
+
+  write := func(dir, relpath string) {
+    fullpath := filepath.Join(dir, relpath)
+    if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+      b.Fatal(err)
+    }
+
+    if err := ioutil.WriteFile(fullpath, data, 0644); err != nil {
+      b.Fatal(err)
+    }
+  }
+
+  for i := 0; i < count; i++ {
+    relpath := filepath.Join(fmt.Sprintf("dir%v", i % 10), fmt.Sprintf("file%v.bin", i))
+    rnd.Read(data)
+
+    switch {
+    case i % 10 == 1:
+      write(installDir, relpath)
+    case i % 10 == 2:
+      write(packageDir, relpath)
+    case i % 5 == 0:
+      write(installDir, relpath)
+      rnd.Read(data)
+      write(packageDir, relpath)
+    default:
+      write(installDir, relpath)
+      write(packageDir, relpath)
+    }
+  }
+
+  return installDir, packageDir
+}
+
+func BenchmarkGenerateDiffs(b *testing.B) {
+  installDir, packageDir := generateTrees(b, 1000, 16 * 1024)
+
+  cases := []struct {
+    name string
+    concurrency int
+  }{
+    {"concurrency-1", 1},
+    {"concurrency-4", 4},
+    {"concurrency-16", 16},
+    // a slot for every file of both dirs is what goroutine per file did
+    {"goroutine-per-file", 2000},
+  }
+
+  for _, c := range cases {
+    concurrency := c.concurrency
+    b.Run(c.name, func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        df := NewDiffGenerator(DiffOptions{
+          InstallDir: filepath.ToSlash(installDir),
+          PackageDir: filepath.ToSlash(packageDir),
+          Concurrency: concurrency,
+        })
+
+        if err := df.GenerateDiffs(context.Background()); err != nil {
+          b.Fatal(err)
+        }
+
+        if len(df.FilesToAdd()) != 100 || len(df.FilesToRemove()) != 100 {
+          b.Fatalf("unexpected diff: %v to add, %v to remove", len(df.FilesToAdd()), len(df.FilesToRemove()))
+        }
+      }
+    })
+  }
+}
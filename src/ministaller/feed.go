@@ -0,0 +1,114 @@
+package ministaller
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+var (
+  ErrNoRelease = errors.New("feed has no releases for the channel")
+)
+
+// FeedRelease is a package published in the update feed
+type FeedRelease struct {
+  Version string `json:"version"`
+  // absolute or relative to the feed location
+  URL string `json:"url"`
+  // sha1 of the package file
+  Hash string `json:"hash"`
+  Size int64 `json:"size,omitempty"`
+  // stable if empty
+  Channel string `json:"channel,omitempty"`
+  // percent of installations which get the release, all if nil
+  Rollout *float64 `json:"rollout,omitempty"`
+}
+
+// Feed lists published releases of the application
+type Feed struct {
+  Releases []*FeedRelease `json:"releases"`
+}
+
+// ParseFeed decodes JSON feed and checks its releases
+func ParseFeed(data []byte) (*Feed, error) {
+  feed := &Feed{}
+  if err := json.Unmarshal(data, feed); err != nil {
+    return nil, err
+  }
+
+  for i, release := range feed.Releases {
+    if release == nil || len(release.URL) == 0 || len(release.Hash) == 0 {
+      return nil, fmt.Errorf("release %v has no url or hash", i)
+    }
+
+    if !IsKnownChannel(release.channel()) {
+      return nil, fmt.Errorf("release %v has unknown channel %v", i, release.Channel)
+    }
+  }
+
+  return feed, nil
+}
+
+// Latest returns the release with the highest version which is available
+// in the channel and rolled out to the installation with the id
+func (f *Feed) Latest(channel, installationID string) (*FeedRelease, error) {
+  var latest *FeedRelease
+
+  for _, release := range f.Releases {
+    if !ChannelIncludes(channel, release.channel()) || !release.RolledOutTo(installationID) {
+      continue
+    }
+
+    if latest == nil || CompareVersions(release.Version, latest.Version) > 0 {
+      latest = release
+    }
+  }
+
+  if latest == nil {
+    return nil, ErrNoRelease
+  }
+
+  return latest, nil
+}
+
+// CompareVersions compares dot-separated versions like 1.10.2 part by part,
+// numeric parts are compared as numbers and the rest as strings.
+// Returns -1, 0 or 1 like strings.Compare
+func CompareVersions(a, b string) int {
+  aparts := splitVersion(a)
+  bparts := splitVersion(b)
+
+  for i := 0; i < len(aparts) || i < len(bparts); i++ {
+    apart, bpart := "0", "0"
+    if i < len(aparts) { apart = aparts[i] }
+    if i < len(bparts) { bpart = bparts[i] }
+
+    anum, aerr := strconv.ParseUint(apart, 10, 64)
+    bnum, berr := strconv.ParseUint(bpart, 10, 64)
+
+    if aerr == nil && berr == nil {
+      if anum < bnum { return -1 }
+      if anum > bnum { return 1 }
+      continue
+    }
+
+    if c := strings.Compare(apart, bpart); c != 0 {
+      return c
+    }
+  }
+
+  return 0
+}
+
+func splitVersion(version string) []string {
+  version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+  if len(version) == 0 {
+    return nil
+  }
+
+  return strings.FieldsFunc(version, func(r rune) bool {
+    return r == '.' || r == '-' || r == '+'
+  })
+}
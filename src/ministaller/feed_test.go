@@ -0,0 +1,128 @@
+package ministaller
+
+import (
+  "testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+  tests := []struct {
+    a string
+    b string
+    want int
+  }{
+    {"1.0", "1.0", 0},
+    {"1.0", "1.0.0", 0},
+    {"v1.2", "1.2", 0},
+    {"", "0", 0},
+    {"1.2", "1.10", -1},
+    {"1.10", "1.9", 1},
+    {"2.0", "10.0", -1},
+    {"1.0.1", "1.0", 1},
+    {"1.0-2", "1.0-10", -1},
+    {"1.0.a", "1.0.b", -1},
+    {"", "1.0", -1},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.a + "/" + tt.b, func(t *testing.T) {
+      if got := CompareVersions(tt.a, tt.b); got != tt.want {
+        t.Fatalf("got %v, expected %v", got, tt.want)
+      }
+
+      if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+        t.Fatalf("reversed comparison got %v, expected %v", got, -tt.want)
+      }
+    })
+  }
+}
+
+func TestFeedLatest(t *testing.T) {
+  const installationID = "05dfdcd9064074022181c56a8837b11e"
+
+  // rollout which includes or excludes the installation
+  rollout := func(version string, included bool) *float64 {
+    percent := RolloutBucket(installationID, version)
+    if included {
+      percent += 0.001
+    }
+
+    return &percent
+  }
+
+  fullRollout := 100.0
+
+  // hash of the release is its version
+  release := func(version, channel string, rollout *float64) *FeedRelease {
+    return &FeedRelease{Version: version, URL: version + ".zip", Hash: version, Channel: channel, Rollout: rollout}
+  }
+
+  tests := []struct {
+    name string
+    releases []*FeedRelease
+    channel string
+    // hash of the expected release, ErrNoRelease if empty
+    want string
+  }{
+    {"empty", nil, StableChannel, ""},
+    {"highest version", []*FeedRelease{
+      release("1.9", "", nil),
+      release("1.10", "", nil),
+      release("1.2", "", nil),
+    }, StableChannel, "1.10"},
+    {"beta is not stable", []*FeedRelease{
+      release("1.0", StableChannel, nil),
+      release("2.0", BetaChannel, nil),
+    }, StableChannel, "1.0"},
+    {"beta includes stable", []*FeedRelease{
+      release("2.0", StableChannel, nil),
+      release("1.5", BetaChannel, nil),
+      release("3.0", NightlyChannel, nil),
+    }, BetaChannel, "2.0"},
+    {"nightly includes all", []*FeedRelease{
+      release("1.0", StableChannel, nil),
+      release("2.0", BetaChannel, nil),
+      release("3.0", NightlyChannel, nil),
+    }, NightlyChannel, "3.0"},
+    {"only other channel", []*FeedRelease{
+      release("2.0", NightlyChannel, nil),
+    }, StableChannel, ""},
+    {"rolled out", []*FeedRelease{
+      release("1.0", "", nil),
+      release("2.0", "", rollout("2.0", true)),
+    }, StableChannel, "2.0"},
+    {"not rolled out", []*FeedRelease{
+      release("1.0", "", nil),
+      release("2.0", "", rollout("2.0", false)),
+    }, StableChannel, "1.0"},
+    {"zero rollout", []*FeedRelease{
+      release("2.0", "", new(float64)),
+    }, StableChannel, ""},
+    {"full rollout", []*FeedRelease{
+      release("1.0", "", nil),
+      release("2.0", "", &fullRollout),
+    }, StableChannel, "2.0"},
+    {"rollout by hash", []*FeedRelease{
+      {URL: "a.zip", Hash: "a", Rollout: rollout("a", true)},
+      {URL: "b.zip", Hash: "b", Rollout: rollout("b", false)},
+    }, StableChannel, "a"},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      feed := &Feed{Releases: tt.releases}
+      latest, err := feed.Latest(tt.channel, installationID)
+
+      if len(tt.want) == 0 {
+        if err != ErrNoRelease {
+          t.Fatalf("got %v, %v instead of no release", latest, err)
+        }
+
+        return
+      }
+
+      if err != nil || latest.Hash != tt.want {
+        t.Fatalf("got %v, %v, expected %v", latest, err, tt.want)
+      }
+    })
+  }
+}
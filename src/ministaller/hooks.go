@@ -0,0 +1,163 @@
+package ministaller
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "time"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  PreInstallStage = "pre-install"
+  PostInstallStage = "post-install"
+  PreRollbackStage = "pre-rollback"
+  PostRollbackStage = "post-rollback"
+
+  defaultHookTimeout = 60 // seconds
+  // how long to wait for output of processes the hook left running
+  hookWaitDelay = 2 * time.Second
+)
+
+// Hook is a command declared by the package to be run at some install stage
+type Hook struct {
+  Command string `json:"command"`
+  Args []string `json:"args"`
+  WorkDir string `json:"workdir"`
+  Env map[string]string `json:"env"`
+  Timeout int `json:"timeout"` // seconds
+  AbortOnFailure bool `json:"abort-on-failure"`
+}
+
+type PackageHooks struct {
+  PreInstall []*Hook `json:"pre-install"`
+  PostInstall []*Hook `json:"post-install"`
+  PreRollback []*Hook `json:"pre-rollback"`
+  PostRollback []*Hook `json:"post-rollback"`
+}
+
+type HookRunner struct {
+  hooks *PackageHooks
+  installDir string
+  packageDir string
+}
+
+func (hr *HookRunner) stageHooks(stage string) []*Hook {
+  if hr == nil || hr.hooks == nil {
+    return nil
+  }
+
+  switch stage {
+  case PreInstallStage: return hr.hooks.PreInstall
+  case PostInstallStage: return hr.hooks.PostInstall
+  case PreRollbackStage: return hr.hooks.PreRollback
+  case PostRollbackStage: return hr.hooks.PostRollback
+  }
+
+  return nil
+}
+
+// runStage runs all hooks of the stage in order and returns the error
+// of the first failed hook which is allowed to abort the install
+func (hr *HookRunner) runStage(ctx context.Context, stage string) error {
+  hooks := hr.stageHooks(stage)
+  if len(hooks) == 0 {
+    return nil
+  }
+
+  log.Printf("Running %v %v hooks", len(hooks), stage)
+
+  for _, hook := range hooks {
+    err := hr.runHook(ctx, stage, hook)
+    if err == nil {
+      continue
+    }
+
+    if hook.AbortOnFailure {
+      return fmt.Errorf("%v hook %v failed: %v", stage, hook.Command, err)
+    }
+
+    logging.WithFields(logging.Fields{logging.FieldStage: stage, logging.FieldPath: hook.Command}).Warnf("Ignoring failure of hook")
+  }
+
+  return nil
+}
+
+func (hr *HookRunner) runHook(parent context.Context, stage string, hook *Hook) error {
+  timeout := hook.Timeout
+  if timeout <= 0 {
+    timeout = defaultHookTimeout
+  }
+
+  ctx, cancel := context.WithTimeout(parent, time.Duration(timeout) * time.Second)
+  defer cancel()
+
+  command := hr.resolveCommand(hook.Command)
+  cmd := exec.CommandContext(ctx, command, hook.Args...)
+  // children of the hook could keep its output open after it was killed
+  cmd.WaitDelay = hookWaitDelay
+
+  cmd.Dir = hr.installDir
+  if len(hook.WorkDir) > 0 {
+    cmd.Dir = hook.WorkDir
+    if !filepath.IsAbs(cmd.Dir) {
+      cmd.Dir = filepath.Join(hr.installDir, cmd.Dir)
+    }
+  }
+
+  cmd.Env = append(os.Environ(),
+    "MINISTALLER_STAGE=" + stage,
+    "MINISTALLER_INSTALL_DIR=" + filepath.FromSlash(hr.installDir),
+    "MINISTALLER_PACKAGE_DIR=" + filepath.FromSlash(hr.packageDir))
+  for key, value := range hook.Env {
+    cmd.Env = append(cmd.Env, key + "=" + value)
+  }
+
+  log.Printf("Running %v hook %v %v in %v", stage, command, hook.Args, cmd.Dir)
+
+  output, err := cmd.CombinedOutput()
+
+  scanner := bufio.NewScanner(bytes.NewReader(output))
+  for scanner.Scan() {
+    logging.WithField(logging.FieldStage, stage).Infof("%v", scanner.Text())
+  }
+
+  if ctx.Err() == context.DeadlineExceeded {
+    err = fmt.Errorf("timed out after %v seconds", timeout)
+  } else if errors.Is(err, exec.ErrWaitDelay) {
+    // the hook itself succeeded, e.g. it started a service
+    logging.WithFields(logging.Fields{logging.FieldStage: stage, logging.FieldPath: command}).Warnf("Hook left processes with its output open")
+    err = nil
+  }
+
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: stage, logging.FieldPath: command, logging.FieldError: err}).Errorf("Hook failed")
+  } else {
+    log.Printf("Hook %v succeeded", command)
+  }
+
+  return err
+}
+
+// resolveCommand looks for relative commands in the package dir first
+// and in the install dir afterwards, otherwise the command is left for PATH lookup
+func (hr *HookRunner) resolveCommand(command string) string {
+  if filepath.IsAbs(command) {
+    return command
+  }
+
+  for _, dir := range []string{hr.packageDir, hr.installDir} {
+    fullpath := filepath.Join(dir, command)
+    if fi, err := os.Stat(fullpath); err == nil && fi.Mode().IsRegular() {
+      return fullpath
+    }
+  }
+
+  return command
+}
@@ -0,0 +1,67 @@
+package ministaller
+
+import (
+  "context"
+  "runtime"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestRunHookStage(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("hooks use sh")
+  }
+
+  shell := func(script string, timeout int, abort bool) *Hook {
+    return &Hook{
+      Command: "sh",
+      Args: []string{"-c", script},
+      Env: map[string]string{"HOOK_VALUE": "from-manifest"},
+      Timeout: timeout,
+      AbortOnFailure: abort,
+    }
+  }
+
+  tests := []struct {
+    name string
+    hook *Hook
+    // error message substring, no error if empty
+    wantErr string
+  }{
+    {"success", shell("exit 0", 0, true), ""},
+    {"env", shell(`test "$MINISTALLER_STAGE" = pre-install && test "$HOOK_VALUE" = from-manifest && test -n "$MINISTALLER_INSTALL_DIR"`, 0, true), ""},
+    {"failure aborts", shell("exit 3", 0, true), "exit status 3"},
+    {"failure ignored", shell("exit 3", 0, false), ""},
+    {"timeout", shell("sleep 30", 1, true), "timed out"},
+    {"timeout with child holding output", shell("sleep 30 & sleep 30", 1, true), "timed out"},
+    {"child left running", shell("sleep 30 & exit 0", 0, true), ""},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      dir := t.TempDir()
+      hr := &HookRunner{
+        hooks: &PackageHooks{PreInstall: []*Hook{tt.hook}},
+        installDir: dir,
+        packageDir: dir,
+      }
+
+      start := time.Now()
+      err := hr.runStage(context.Background(), PreInstallStage)
+
+      if len(tt.wantErr) == 0 && err != nil {
+        t.Fatalf("unexpected hook error: %v", err)
+      }
+
+      if len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+        t.Fatalf("hook error %v does not contain %q", err, tt.wantErr)
+      }
+
+      // processes left by the hook are not waited for
+      if elapsed := time.Since(start); elapsed > 10 * time.Second {
+        t.Fatalf("hook took %v", elapsed)
+      }
+    })
+  }
+}
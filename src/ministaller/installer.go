@@ -0,0 +1,1129 @@
+// Package ministaller diffs the install dir against the update package
+// and installs the difference with rollback on failure
+package ministaller
+
+import (
+  "context"
+  "path"
+  "os"
+  "sync"
+  "sort"
+  "io"
+  "path/filepath"
+  "strings"
+  "log"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  CopyPrice = 100
+  RenamePrice = CopyPrice
+
+  RemoveBackupPrice = 30
+  MovePrice = 30
+  RemoveFactor = RenamePrice
+  UpdateFactor = RenamePrice + CopyPrice
+  AddFactor = CopyPrice
+)
+
+const (
+  BackupExt = ".bak"
+  // new contents are written next to the target and renamed over it
+  NewFileExt = ".ministaller-new"
+)
+
+// log stages which are not progress stages
+const (
+  preflightStage = "preflight"
+  installStage = "install"
+  rollbackStage = "rollback"
+)
+
+type BackupPair struct {
+  relpath string
+  newpath string
+  // hash of the backed up file to verify the restore
+  sha1 string
+}
+
+type CopyRequest struct {
+  from, to string
+}
+
+type PackageInstaller struct {
+  backups map[string]string
+  backupHashes map[string]string
+  // files which did not exist before the install
+  addedFiles map[string]bool
+  addedMutex sync.Mutex
+  rollbackFailures rollbackFailures
+  moves []*MoveFileInfo
+  createdDirs map[string]bool
+  dirsMutex sync.Mutex
+  backupsChan chan BackupPair
+  backupsWG sync.WaitGroup
+  progressReporter *ProgressReporter
+  installDir string
+  packageDir string
+  selfPath string // full path of the running installer
+  removeSelfPath string // if updating the installer
+  copyPool *fsutil.WorkerPool
+  criticalFiles map[string]bool // installed last and sequentially
+  hookRunner *HookRunner
+  journal *installJournal
+  report *InstallReport
+  metadataPolicy *fsutil.MetadataPolicy
+  inUse InUseStrategy
+  fs fsutil.FS
+}
+
+// InstallOptions configure PackageInstaller
+type InstallOptions struct {
+  InstallDir string
+  PackageDir string
+  // receives progress of the install, logging reporter is used if nil
+  Reporter *ProgressReporter
+  // max number of files copied in parallel, 0 to detect
+  CopyConcurrency int
+  // relative paths of files to install last and sequentially
+  CriticalFiles []string
+  // hooks from the package manifest
+  Hooks *PackageHooks
+  Metadata *fsutil.MetadataPolicy
+  // full path of the running installer if it can be updated too
+  SelfPath string
+  // file system with install and package dirs, the real one if nil
+  FS fsutil.FS
+  // receives every operation, errors and rollback outcome if not nil
+  Report *InstallReport
+  // replaces and removes files in use, platform default if nil
+  InUse InUseStrategy
+}
+
+func NewPackageInstaller(options InstallOptions) *PackageInstaller {
+  installDir := filepath.ToSlash(options.InstallDir)
+  packageDir := filepath.ToSlash(options.PackageDir)
+
+  fsys := options.FS
+  if fsys == nil {
+    fsys = fsutil.OS
+  }
+
+  reporter := options.Reporter
+  if reporter == nil {
+    reporter = NewProgressReporter(&LogProgressHandler{})
+  }
+
+  concurrency := options.CopyConcurrency
+  if concurrency <= 0 {
+    concurrency = fsutil.DefaultConcurrency(installDir)
+  }
+
+  criticalFiles := make(map[string]bool)
+  for _, relpath := range options.CriticalFiles {
+    criticalFiles[filepath.ToSlash(relpath)] = true
+  }
+
+  inUse := options.InUse
+  if inUse == nil {
+    inUse = NewInUseStrategy(installDir)
+  }
+
+  // the installer itself is replaced only after everything else
+  if selfpath, ok := selfRelativePath(installDir, options.SelfPath); ok {
+    criticalFiles[selfpath] = true
+  }
+
+  return &PackageInstaller{
+    backups: make(map[string]string),
+    backupHashes: make(map[string]string),
+    addedFiles: make(map[string]bool),
+    createdDirs: make(map[string]bool),
+    backupsChan: make(chan BackupPair),
+    progressReporter: reporter,
+    installDir: installDir,
+    packageDir: packageDir,
+    selfPath: options.SelfPath,
+    copyPool: fsutil.NewWorkerPool(concurrency),
+    criticalFiles: criticalFiles,
+    hookRunner: &HookRunner{
+      hooks: options.Hooks,
+      installDir: installDir,
+      packageDir: packageDir,
+    },
+    metadataPolicy: options.Metadata,
+    inUse: inUse,
+    fs: fsys,
+    report: options.Report,
+  }
+}
+
+// Install applies the diff to the install dir. If ctx is cancelled, install
+// stops after the file being processed and everything is rolled back
+func (pi *PackageInstaller) Install(ctx context.Context, filesProvider UpdateFilesProvider) error {
+  defer func() {
+    if r := recover(); r != nil {
+      logging.WithField(logging.FieldStage, installStage).Errorf("Recovered in install... %v", r)
+      pi.afterFailure(filesProvider)
+    }
+  }()
+  
+  pi.progressReporter.grandTotal = pi.calculateGrandTotals(filesProvider)
+  pi.progressReporter.setStageTotals(pi.calculateStageTotals(filesProvider))
+  
+  go pi.progressReporter.reportingLoop()
+
+  err := pi.preflight(filesProvider)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: preflightStage, logging.FieldError: err}).Warnf("Preflight check failed")
+    pi.report.AddError(err)
+    pi.progressReporter.sendSystemMessage(err.Error())
+    pi.teardown()
+    return err
+  }
+
+  pi.beforeInstall()
+
+  pi.journal, err = openJournal(pi.fs, pi.installDir)
+
+  if err == nil {
+    err = pi.hookRunner.runStage(ctx, PreInstallStage)
+  }
+
+  if err == nil {
+    err = pi.installPackage(ctx, filesProvider)
+  }
+
+  if err == nil {
+    err = pi.hookRunner.runStage(ctx, PostInstallStage)
+  }
+
+  if (err == nil) && (ctx.Err() != nil) {
+    err = ctx.Err()
+  }
+
+  pi.report.AddError(err)
+
+  if err == nil {
+    pi.journal.record(journalEntry{Op: journalCommit})
+    pi.afterSuccess(filesProvider)
+  } else {
+    pi.afterFailure(filesProvider)
+  }
+
+  if failures := pi.rollbackFailures.list(); len(failures) > 0 {
+    err = &RollbackError{Err: err, Failures: failures}
+    logging.WithFields(logging.Fields{logging.FieldStage: rollbackStage, logging.FieldError: err}).Errorf("Rollback is incomplete")
+    pi.notifyError("Rollback is incomplete, please run the installer again to retry it")
+    // keep the journal so the rollback can be retried
+    pi.journal.close()
+  } else {
+    pi.journal.remove()
+  }
+  
+  pi.teardown()
+
+  return err
+}
+
+func (pi *PackageInstaller) calculateGrandTotals(filesProvider UpdateFilesProvider) uint64 {
+  var sum uint64
+
+  for _, fi := range filesProvider.FilesToRemove() {
+    sum += uint64(fi.FileSize * RemoveFactor) / 100
+    sum += uint64(fi.FileSize * RemoveBackupPrice) / 100
+  }
+
+  for _, fi := range filesProvider.FilesToUpdate() {
+    sum += uint64(fi.FileSize * UpdateFactor) / 100
+    sum += uint64(fi.FileSize * RemoveBackupPrice) / 100
+  }
+
+  for _, fi := range filesProvider.FilesToAdd() {
+    sum += uint64(fi.FileSize * AddFactor) / 100
+  }
+
+  sum += uint64(len(filesProvider.FilesToMove()) * MovePrice)
+
+  return sum
+}
+
+// calculateStageTotals returns real bytes to be processed by each stage
+func (pi *PackageInstaller) calculateStageTotals(filesProvider UpdateFilesProvider) (totals [stagesCount]uint64) {
+  for _, fi := range filesProvider.FilesToRemove() {
+    totals[RemovingStage] += uint64(fi.FileSize)
+  }
+
+  for _, mi := range filesProvider.FilesToMove() {
+    totals[MovingStage] += uint64(mi.FileSize)
+  }
+
+  for _, fi := range filesProvider.FilesToUpdate() {
+    totals[UpdatingStage] += uint64(fi.FileSize)
+  }
+
+  for _, fi := range filesProvider.FilesToAdd() {
+    totals[AddingStage] += uint64(fi.FileSize)
+  }
+
+  return totals
+}
+
+func (pi *PackageInstaller) beforeInstall() {
+  log.Println("Before install")
+  pi.removeOldBackups()
+}
+
+func (pi *PackageInstaller) installPackage(ctx context.Context, filesProvider UpdateFilesProvider) (err error) {
+  log.Println("Installing package...")
+
+  go pi.accountBackups()  
+  
+  defer func() {
+    // all backups have to be accounted before the rollback
+    log.Println("Waiting for backups to finish accounting...")
+    pi.backupsWG.Wait()
+    close(pi.backupsChan)
+  }()
+
+  pi.progressReporter.sendSystemMessage("Removing components...")
+  err = pi.removeFiles(ctx, filesProvider.FilesToRemove())
+  if err != nil {
+    return err
+  }
+
+  pi.progressReporter.sendSystemMessage("Moving components...")
+  err = pi.moveFiles(ctx, filesProvider.FilesToMove())
+  if err != nil {
+    return err
+  }
+
+  filesToUpdate, criticalToUpdate := pi.splitCriticalFiles(filesProvider.FilesToUpdate())
+  filesToAdd, criticalToAdd := pi.splitCriticalFiles(filesProvider.FilesToAdd())
+
+  pi.progressReporter.sendSystemMessage("Updating components...")
+  err = pi.updateFiles(ctx, filesToUpdate)
+  if err != nil {
+    return err
+  }
+
+  pi.progressReporter.sendSystemMessage("Adding components...")
+  err = pi.addFiles(ctx, filesToAdd)
+  if err != nil {
+    return err
+  }
+
+  err = pi.addDirs(ctx, filesProvider.DirsToAdd())
+  if err != nil {
+    return err
+  }
+
+  if len(criticalToUpdate) + len(criticalToAdd) > 0 {
+    log.Printf("Installing %v critical files", len(criticalToUpdate) + len(criticalToAdd))
+    pi.progressReporter.sendSystemMessage("Finalizing components...")
+
+    for _, fi := range criticalToUpdate {
+      if err = ctx.Err(); err != nil {
+        return err
+      }
+
+      if err = pi.updateFile(fi); err != nil {
+        return err
+      }
+    }
+
+    for _, fi := range criticalToAdd {
+      if err = ctx.Err(); err != nil {
+        return err
+      }
+
+      if err = pi.addFile(fi); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// splitCriticalFiles separates files which have to be installed at the very end
+func (pi *PackageInstaller) splitCriticalFiles(files []*UpdateFileInfo) (regular, critical []*UpdateFileInfo) {
+  for _, fi := range files {
+    if pi.criticalFiles[fi.Filepath] {
+      critical = append(critical, fi)
+    } else {
+      regular = append(regular, fi)
+    }
+  }
+
+  return regular, critical
+}
+
+// copyInParallel runs action for every file in the copy pool and returns
+// the first error. Files not yet started are skipped after a failure
+func (pi *PackageInstaller) copyInParallel(ctx context.Context, files []*UpdateFileInfo, action func(*UpdateFileInfo) error) error {
+  group := pi.copyPool.NewGroup()
+
+  for _, fi := range files {
+    fi := fi
+    group.Go(func() error {
+      // file being copied is finished, the rest is skipped
+      if err := ctx.Err(); err != nil {
+        return err
+      }
+
+      return action(fi)
+    })
+  }
+
+  return group.Wait()
+}
+
+func (pi *PackageInstaller) accountBackups() {
+  // backups map can be already used by the rollback after the last Done()
+  count := 0
+  for bp := range pi.backupsChan {
+    pi.backups[bp.relpath] = bp.newpath
+    pi.backupHashes[bp.relpath] = bp.sha1
+    count++
+    pi.backupsWG.Done()
+  }
+  
+  log.Printf("Backups accounting finished. %v backups available", count)
+}
+
+func (pi *PackageInstaller) afterSuccess(filesProvider UpdateFilesProvider) {
+  log.Println("After success")
+  pi.progressReporter.sendSystemMessage("Finishing the installation...")
+  pi.removeBackups()
+  pi.cleanupEmptyDirs(emptiedDirs(filesProvider), true)
+}
+
+func (pi *PackageInstaller) afterFailure(filesProvider UpdateFilesProvider) {
+  log.Println("After failure")
+  pi.progressReporter.sendSystemMessage("Cleaning up...")
+  pi.report.startRollback()
+
+  // rollback is never cancelled
+  if err := pi.hookRunner.runStage(context.Background(), PreRollbackStage); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: rollbackStage, logging.FieldError: err}).Errorf("Pre-rollback hooks failed")
+    pi.report.addRollbackError(err)
+  }
+
+  pi.purgeAddedFiles()
+  pi.revertMoves()
+  pi.restoreBackups()
+
+  // backups which failed to restore are the only copy left
+  if len(pi.rollbackFailures.list()) == 0 {
+    pi.removeBackups()
+  }
+
+  pi.cleanupEmptyDirs(pi.createdDirsList(), false)
+
+  if err := pi.hookRunner.runStage(context.Background(), PostRollbackStage); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: rollbackStage, logging.FieldError: err}).Errorf("Post-rollback hooks failed")
+    pi.report.addRollbackError(err)
+  }
+}
+
+func (pi *PackageInstaller) createdDirsList() []string {
+  pi.dirsMutex.Lock()
+  defer pi.dirsMutex.Unlock()
+
+  dirs := make([]string, 0, len(pi.createdDirs))
+  for dir := range pi.createdDirs {
+    dirs = append(dirs, dir)
+  }
+
+  return dirs
+}
+
+func (pi *PackageInstaller) teardown() {
+  log.Println("Teardown stage!")
+  
+  pi.progressReporter.waitProgressReported()
+  pi.progressReporter.shutdown()
+  pi.progressReporter.receiveFinish()
+}
+
+// copyFile copies contents and metadata of src to dst.
+// Symlinks are copied as symlinks with the same target
+func (pi *PackageInstaller) copyFile(src, dst string) error {
+  logging.WithField(logging.FieldPath, dst).Debugf("About to copy file %v", src)
+
+  fi, err := pi.fs.Lstat(src)
+  if err != nil { return err }
+
+  if fsutil.IsSymlink(fi.Mode()) {
+    target, err := pi.fs.Readlink(src)
+    if err != nil { return err }
+
+    return pi.metadataPolicy.CreateSymlink(pi.fs, target, dst, fsutil.MetadataFromFileInfo(fi))
+  }
+
+  tmppath := dst + NewFileExt
+
+  err = copyFileContents(pi.fs, src, tmppath)
+  if err == nil {
+    err = pi.metadataPolicy.Apply(pi.fs, tmppath, fsutil.MetadataFromFileInfo(fi), false)
+  }
+
+  if err == nil {
+    // rename makes replacement atomic, especially for the running installer
+    err = pi.inUse.Replace(pi.fs, tmppath, dst)
+  }
+
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: dst, logging.FieldError: err}).Warnf("Failed to copy %v", src)
+    pi.fs.Remove(tmppath)
+  }
+
+  return err
+}
+
+func copyFileContents(fsys fsutil.FS, src, dst string) (err error) {
+  in, err := fsys.Open(src)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: src, logging.FieldError: err}).Warnf("Failed to open source")
+    return err
+  }
+
+  defer in.Close()
+
+  // real permissions are set afterwards by the metadata policy
+  out, err := fsys.OpenFile(dst, os.O_RDWR | os.O_TRUNC | os.O_CREATE, fsutil.DefaultFileMode)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: dst, logging.FieldError: err}).Warnf("Failed to create destination")
+    return
+  }
+
+  defer func() {
+    cerr := out.Close()
+    if err == nil {
+      err = cerr
+    }
+  }()
+
+  if _, err = io.Copy(out, in); err != nil {
+    return
+  }
+
+  err = out.Sync()
+  return
+}
+
+func (pi *PackageInstaller) backupFile(stage ProgressStage, relpath, sha1 string) error {
+  entry := fileLog(stage.String(), "backup", relpath)
+  entry.Debugf("Backing up file")
+
+  if err := pi.checkInstallPath(relpath); err != nil {
+    entry.WithError(err).Errorf("Backup failed")
+    return err
+  }
+
+  oldpath := path.Join(pi.installDir, relpath)
+  backupPath := relpath + BackupExt
+
+  newpath := path.Join(pi.installDir, backupPath)
+  // remove previous backup if any
+  pi.fs.Remove(newpath)
+
+  if err := pi.journal.record(journalEntry{Op: journalBackup, Path: relpath, Backup: backupPath, Sha1: sha1}); err != nil {
+    return err
+  }
+
+  // assume backups are ALWAYS created in the same directory
+  // otherwise pi.fs.Rename() could be screwed with different harddrives
+  err := pi.fs.Rename(oldpath, newpath)
+
+  if err == nil {
+    pi.backupsWG.Add(1)
+    go func() {
+      pi.backupsChan <- BackupPair{relpath: relpath, newpath: newpath, sha1: sha1}
+    }()
+  } else {
+    entry.WithError(err).Errorf("Backup failed")
+  }
+
+  return err
+}
+
+func (pi *PackageInstaller) restoreBackups() {
+  log.Printf("Restoring %v backups", len(pi.backups))
+  var wg sync.WaitGroup
+
+  var restoredMutex sync.Mutex
+  restored := make([]string, 0, len(pi.backups))
+
+  for relpath, backuppath := range pi.backups {
+    wg.Add(1)
+
+    go func(relativePath, pathToRestore string) {
+      defer wg.Done()
+
+      oldpath := path.Join(pi.installDir, relativePath)
+      entry := fileLog(rollbackStage, "restore", relativePath)
+      entry.Infof("Restoring backup %v", pathToRestore)
+
+      // backups are supposed to be in the same location as files
+      // so rename operaion will not be screwed with by paths
+      // on different harddrives
+      err := restoreFile(pi.fs, pathToRestore, oldpath, pi.backupHashes[relativePath])
+
+      if err != nil {
+        entry.WithError(err).Errorf("Error while restoring backup")
+        pi.report.addRollbackError(err)
+        pi.rollbackFailures.add(relativePath, err)
+        return
+      }
+
+      restoredMutex.Lock()
+      restored = append(restored, relativePath)
+      restoredMutex.Unlock()
+    }(relpath, backuppath)
+  }
+
+  wg.Wait()
+
+  for _, relpath := range restored {
+    delete(pi.backups, relpath)
+  }
+}
+
+func (pi *PackageInstaller) removeOldBackups() {
+  if len(pi.selfPath) == 0 {
+    return
+  }
+
+  backeduppath := pi.selfPath + BackupExt
+  err := pi.fs.Remove(backeduppath)
+  if err == nil {
+    log.Println("Old installer backup removed", backeduppath)
+  } else if os.IsNotExist(err) {
+    log.Println("Old installer backup was not found")
+  } else {
+    logging.WithFields(logging.Fields{logging.FieldPath: backeduppath, logging.FieldError: err}).Warnf("Error while removing old backup")
+  }
+}
+
+func (pi *PackageInstaller) removeBackups() {
+  log.Printf("Removing %v backups", len(pi.backups))
+
+  if selfpath, ok := selfRelativePath(pi.installDir, pi.selfPath); ok {
+    if backuppath, ok := pi.backups[selfpath]; ok {
+      pi.removeSelfPath = backuppath
+      delete(pi.backups, selfpath)
+      log.Printf("Removed exe path %v from backups. %v backups left", selfpath, len(pi.backups))
+    }
+  }
+
+  for _, backuppath := range pi.backups {
+    entry := fileLog(CleanupStage.String(), "remove-backup", backuppath)
+    entry.Debugf("Removing backup")
+    // backup of a file in use is removed later
+    err := pi.inUse.Remove(pi.fs, backuppath)
+    if err != nil {
+      entry.WithError(err).Warnf("Error while removing backup")
+    }
+
+    pi.progressReporter.accountBackupRemove()
+  }
+
+  log.Println("Backups removed")
+}
+
+func (pi *PackageInstaller) removeFiles(ctx context.Context, files []*UpdateFileInfo) error {
+  log.Printf("Removing %v files", len(files))
+
+  for _, fi := range files {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    pathToRemove, filesize := fi.Filepath, fi.FileSize
+
+    entry := fileLog(RemovingStage.String(), "remove", pathToRemove)
+    entry.Infof("Removing file")
+
+    // real removal will happen in the end when backup will be removed
+    err := pi.backupFile(RemovingStage, pathToRemove, fi.Sha1)
+
+    if err != nil {
+      entry.WithError(err).Errorf("Removing file failed")
+    }
+
+    op := &ReportOperation{Op: "remove", Path: pathToRemove, Size: filesize, OldSha1: fi.Sha1, Error: errorString(err)}
+    if err == nil {
+      op.Backup = pathToRemove + BackupExt
+    }
+
+    pi.report.addOperation(op)
+
+    // file removed by somebody else is not an error
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+
+    pi.progressReporter.accountRemove(filesize)
+    pi.progressReporter.reportFileActivity("Removing", pathToRemove)
+  }
+
+  return nil
+}
+
+func (pi *PackageInstaller) moveFiles(ctx context.Context, files []*MoveFileInfo) error {
+  log.Printf("Moving %v files", len(files))
+
+  for _, mi := range files {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    oldpath := path.Join(pi.installDir, mi.FromPath)
+    newpath := path.Join(pi.installDir, mi.ToPath)
+    entry := fileLog(MovingStage.String(), "move", mi.ToPath)
+    entry.Infof("Moving file from %v", mi.FromPath)
+
+    for _, relpath := range []string{mi.FromPath, mi.ToPath} {
+      if err := pi.checkInstallPath(relpath); err != nil {
+        entry.WithError(err).Errorf("Moving file failed")
+        return err
+      }
+    }
+
+    if err := pi.ensurePackageDir(path.Dir(mi.ToPath)); err != nil {
+      return err
+    }
+
+    if err := pi.journal.record(journalEntry{Op: journalMove, Path: mi.ToPath, From: mi.FromPath, Sha1: mi.Sha1}); err != nil {
+      return err
+    }
+
+    // both paths are inside of the install dir so rename is enough
+    err := pi.fs.Rename(oldpath, newpath)
+    pi.report.addOperation(&ReportOperation{
+      Op: "move",
+      Path: mi.ToPath,
+      From: mi.FromPath,
+      Size: mi.FileSize,
+      Sha1: mi.Sha1,
+      Error: errorString(err),
+    })
+
+    if err != nil {
+      entry.WithError(err).Errorf("Moving file failed")
+      return err
+    }
+
+    pi.moves = append(pi.moves, mi)
+    pi.progressReporter.accountMove(mi.FileSize)
+    pi.progressReporter.reportFileActivity("Moving", mi.ToPath)
+  }
+
+  return nil
+}
+
+func (pi *PackageInstaller) revertMoves() {
+  log.Printf("Reverting %v moves", len(pi.moves))
+
+  for i := len(pi.moves) - 1; i >= 0; i-- {
+    mi := pi.moves[i]
+    oldpath := path.Join(pi.installDir, mi.FromPath)
+    newpath := path.Join(pi.installDir, mi.ToPath)
+    entry := fileLog(rollbackStage, "move-back", mi.FromPath)
+    entry.Infof("Moving back from %v", mi.ToPath)
+
+    ensureDirExists(pi.fs, oldpath)
+
+    err := restoreFile(pi.fs, newpath, oldpath, mi.Sha1)
+    if err != nil {
+      entry.WithError(err).Errorf("Error while moving back")
+      pi.report.addRollbackError(err)
+      pi.rollbackFailures.add(mi.FromPath, err)
+    }
+  }
+
+  pi.moves = nil
+}
+
+func (pi *PackageInstaller) updateFiles(ctx context.Context, files []*UpdateFileInfo) error {
+  log.Printf("Updating %v files", len(files))
+  return pi.copyInParallel(ctx, files, pi.updateFile)
+}
+
+func (pi *PackageInstaller) updateFile(fi *UpdateFileInfo) error {
+  pathToUpdate, filesize := fi.Filepath, fi.FileSize
+
+  oldpath := path.Join(pi.installDir, pathToUpdate)
+  entry := fileLog(UpdatingStage.String(), "update", pathToUpdate)
+  entry.Infof("Updating file")
+
+  if err := pi.checkInstallPath(pathToUpdate); err != nil {
+    entry.WithError(err).Errorf("Updating file failed")
+    return err
+  }
+
+  backup := pathToUpdate + BackupExt
+  err := pi.backupFile(UpdatingStage, pathToUpdate, fi.OldSha1)
+  if err != nil && !os.IsNotExist(err) {
+    // the file could not be restored on rollback
+    entry.WithError(err).Errorf("Updating file failed")
+    return err
+  } else if err != nil {
+    entry.WithError(err).Warnf("File to update does not exist")
+    backup = ""
+  }
+
+  newpath := path.Join(pi.packageDir, pathToUpdate)
+  err = pi.fs.Remove(oldpath)
+  if err != nil && !os.IsNotExist(err) { entry.WithError(err).Warnf("Error while removing") }
+
+  // just os.Rename does not work if files are on different drive
+  err = pi.copyFile(newpath, oldpath)
+  pi.progressReporter.accountUpdate(filesize)
+  pi.progressReporter.reportFileActivity("Updating", pathToUpdate)
+
+  pi.report.addOperation(&ReportOperation{
+    Op: "update",
+    Path: pathToUpdate,
+    Size: filesize,
+    OldSha1: fi.OldSha1,
+    Sha1: fi.Sha1,
+    Backup: backup,
+    Error: errorString(err),
+  })
+
+  if err != nil {
+    entry.WithError(err).Errorf("Updating file failed")
+    // partially copied file would prevent restoring the backup
+    pi.fs.Remove(oldpath)
+  }
+
+  return err
+}
+
+func (pi *PackageInstaller) addFiles(ctx context.Context, files []*UpdateFileInfo) error {
+  log.Printf("Adding %v files", len(files))
+  return pi.copyInParallel(ctx, files, pi.addFile)
+}
+
+func (pi *PackageInstaller) addFile(fi *UpdateFileInfo) error {
+  pathToAdd, filesize := fi.Filepath, fi.FileSize
+
+  oldpath := path.Join(pi.installDir, pathToAdd)
+  if err := pi.checkInstallPath(pathToAdd); err != nil {
+    fileLog(AddingStage.String(), "add", pathToAdd).WithError(err).Errorf("Adding file failed")
+    return err
+  }
+
+  if err := pi.ensurePackageDir(path.Dir(pathToAdd)); err != nil {
+    return err
+  }
+
+  entry := fileLog(AddingStage.String(), "add", pathToAdd)
+  entry.Infof("Adding file")
+
+  var err error
+  if _, serr := pi.fs.Lstat(oldpath); serr == nil {
+    // appeared after the diff was made, rollback has to bring it back
+    entry.Warnf("File to add already exists")
+    err = pi.backupFile(AddingStage, pathToAdd, "")
+  } else {
+    pi.addedMutex.Lock()
+    pi.addedFiles[pathToAdd] = true
+    pi.addedMutex.Unlock()
+  }
+
+  if err == nil {
+    err = pi.journal.record(journalEntry{Op: journalAdd, Path: pathToAdd})
+  }
+
+  if err != nil {
+    return err
+  }
+
+  if len(fi.LocalSource) > 0 {
+    err = pi.copyFile(path.Join(pi.installDir, fi.LocalSource), oldpath)
+    if err != nil {
+      entry.WithError(err).Warnf("Copying local file %v failed", fi.LocalSource)
+    }
+  }
+
+  fromPackage := (len(fi.LocalSource) == 0) || (err != nil)
+  if fromPackage {
+    newpath := path.Join(pi.packageDir, pathToAdd)
+    err = pi.copyFile(newpath, oldpath)
+  }
+
+  op := &ReportOperation{
+    Op: "add",
+    Path: pathToAdd,
+    Size: filesize,
+    Sha1: fi.Sha1,
+    Error: errorString(err),
+  }
+
+  if len(fi.LocalSource) > 0 && !fromPackage {
+    op.From = fi.LocalSource
+  }
+
+  pi.report.addOperation(op)
+
+  if err != nil {
+    entry.WithError(err).Errorf("Adding file failed")
+    return err
+  }
+
+  pi.progressReporter.accountAdd(filesize)
+  pi.progressReporter.reportFileActivity("Adding", pathToAdd)
+
+  return nil
+}
+
+func errorString(err error) string {
+  if err == nil {
+    return ""
+  }
+
+  return err.Error()
+}
+
+// fileLog starts the log record of the operation on the file
+func fileLog(stage, op, relpath string) *logging.Entry {
+  return logging.WithFields(logging.Fields{
+    logging.FieldStage: stage,
+    logging.FieldOp: op,
+    logging.FieldPath: relpath,
+  })
+}
+
+// RemoveSelfIfNeeded removes backup of the updated installer,
+// it has to be called right before the installer exits
+func (pi *PackageInstaller) RemoveSelfIfNeeded() {
+  if len(pi.removeSelfPath) == 0 {
+    log.Println("No need to remove itself")
+    return
+  }
+
+  log.Println("Removing exe backup", pi.removeSelfPath)
+  err := fsutil.RemoveFileLater(pi.removeSelfPath)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: pi.removeSelfPath, logging.FieldError: err}).Warnf("Failed to schedule exe backup removal")
+  }
+}
+
+// selfRelativePath returns path of the running installer relative
+// to the install dir if the installer is located inside of it
+func selfRelativePath(installDir, selfPath string) (string, bool) {
+  if len(selfPath) == 0 {
+    return "", false
+  }
+
+  root := installDir
+  if resolved, err := filepath.EvalSymlinks(installDir); err == nil {
+    root = resolved
+  }
+
+  relpath, err := filepath.Rel(root, selfPath)
+  if err != nil || relpath == ".." || strings.HasPrefix(relpath, ".." + string(filepath.Separator)) {
+    return "", false
+  }
+
+  return filepath.ToSlash(relpath), true
+}
+
+// purgeAddedFiles removes files which were added by the install.
+// Files which existed before are restored from backups instead
+func (pi *PackageInstaller) purgeAddedFiles() {
+  pi.addedMutex.Lock()
+  defer pi.addedMutex.Unlock()
+
+  log.Printf("Purging %v files", len(pi.addedFiles))
+
+  for relpath := range pi.addedFiles {
+    fullpath := path.Join(pi.installDir, relpath)
+    entry := fileLog(rollbackStage, "purge", relpath)
+    entry.Debugf("Purging file")
+
+    err := retryOperation(func() error {
+      return pi.fs.Remove(fullpath)
+    })
+
+    if err != nil && !os.IsNotExist(err) {
+      entry.WithError(err).Errorf("Error while purging file")
+      pi.report.addRollbackError(err)
+      pi.rollbackFailures.add(relpath, err)
+    }
+  }
+
+  log.Println("Finished purging files")
+}
+
+// checkInstallPath refuses to write relpath through a symlinked
+// directory which could point outside of the install dir
+func (pi *PackageInstaller) checkInstallPath(relpath string) error {
+  return fsutil.CheckNoSymlinkParents(pi.fs, pi.installDir, path.Join(pi.installDir, relpath))
+}
+
+func ensureDirExists(fsys fsutil.FS, fullpath string) (err error) {
+  logging.WithField(logging.FieldPath, fullpath).Debugf("Ensuring directory exists")
+  dirpath := path.Dir(fullpath)
+  err = fsys.MkdirAll(dirpath, fsutil.DefaultDirMode)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "mkdir", logging.FieldPath: dirpath, logging.FieldError: err}).Errorf("Failed to create directory")
+  }
+
+  return err
+}
+
+// ensurePackageDir creates reldir and its missing parents
+// with the same permissions they have in the package.
+// Parallel copy workers are serialized so each dir is created once
+func (pi *PackageInstaller) ensurePackageDir(reldir string) error {
+  pi.dirsMutex.Lock()
+  defer pi.dirsMutex.Unlock()
+
+  missing := make([]string, 0)
+
+  for dir := reldir; dir != "." && dir != "/"; dir = path.Dir(dir) {
+    if _, err := pi.fs.Stat(path.Join(pi.installDir, dir)); err == nil {
+      break
+    }
+
+    missing = append(missing, dir)
+  }
+
+  if len(missing) == 0 {
+    return nil
+  }
+
+  // parents go first so they are removed last on recovery
+  for i := len(missing) - 1; i >= 0; i-- {
+    if err := pi.journal.record(journalEntry{Op: journalMkdir, Path: missing[i]}); err != nil {
+      return err
+    }
+  }
+
+  dirpath := path.Join(pi.installDir, reldir)
+  entry := fileLog(AddingStage.String(), "mkdir", reldir)
+  entry.Infof("Creating directory")
+
+  err := pi.fs.MkdirAll(dirpath, fsutil.DefaultDirMode)
+  for _, dir := range missing {
+    pi.report.addOperation(&ReportOperation{Op: "mkdir", Path: dir, Error: errorString(err)})
+  }
+
+  if err != nil {
+    entry.WithError(err).Errorf("Failed to create directory")
+    return err
+  }
+
+  for _, dir := range missing {
+    pi.createdDirs[dir] = true
+  }
+
+  for _, dir := range missing {
+    fi, err := pi.fs.Stat(path.Join(pi.packageDir, dir))
+    if err != nil { continue }
+
+    md := fsutil.MetadataFromFileInfo(fi)
+    // modification time would be changed anyway by adding files
+    md.ModTime = time.Time{}
+    pi.metadataPolicy.Apply(pi.fs, path.Join(pi.installDir, dir), md, true)
+  }
+
+  return nil
+}
+
+func (pi *PackageInstaller) addDirs(ctx context.Context, dirs []*UpdateFileInfo) error {
+  log.Printf("Adding %v directories", len(dirs))
+
+  for _, di := range dirs {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    err := pi.ensurePackageDir(di.Filepath)
+    if err != nil {
+      fileLog(AddingStage.String(), "mkdir", di.Filepath).WithError(err).Errorf("Adding directory failed")
+      return err
+    }
+  }
+
+  return nil
+}
+
+// emptiedDirs returns directories which could be emptied by the install:
+// ones which contained removed or moved files and the removed directories
+func emptiedDirs(filesProvider UpdateFilesProvider) []string {
+  dirs := make([]string, 0)
+
+  for _, fi := range filesProvider.FilesToRemove() {
+    dirs = append(dirs, path.Dir(fi.Filepath))
+  }
+
+  for _, mi := range filesProvider.FilesToMove() {
+    dirs = append(dirs, path.Dir(mi.FromPath))
+  }
+
+  for _, di := range filesProvider.DirsToRemove() {
+    dirs = append(dirs, di.Filepath)
+  }
+
+  return dirs
+}
+
+// cleanupEmptyDirs removes given dirs if they are empty. With parents
+// their ancestors are candidates too since they contained these dirs
+func (pi *PackageInstaller) cleanupEmptyDirs(reldirs []string, withParents bool) {
+  candidates := make(map[string]bool)
+
+  for _, dir := range reldirs {
+    for ; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+      candidates[dir] = true
+      if !withParents { break }
+    }
+  }
+
+  dirs := make([]string, 0, len(candidates))
+  for dir := range candidates {
+    dirs = append(dirs, path.Join(pi.installDir, dir))
+  }
+
+  log.Printf("Cleaning up %v directories", len(dirs))
+  removeEmptyDirs(pi.fs, dirs)
+}
+
+type ByLength []string
+
+func (s ByLength) Len() int {
+    return len(s)
+}
+func (s ByLength) Swap(i, j int) {
+    s[i], s[j] = s[j], s[i]
+}
+func (s ByLength) Less(i, j int) bool {
+    return len(s[i]) > len(s[j])
+}
+
+func removeEmptyDirs(fsys fsutil.FS, dirs []string) {
+  sort.Sort(ByLength(dirs))
+
+  for _, dirpath := range dirs {
+    entries, err := fsys.ReadDir(dirpath)
+    if err != nil { continue }
+
+    if len(entries) == 0 {
+      entry := logging.WithFields(logging.Fields{logging.FieldOp: "rmdir", logging.FieldPath: dirpath})
+      entry.Debugf("Removing empty dir")
+
+      err = fsys.Remove(dirpath)
+      if err != nil {
+        entry.WithError(err).Warnf("Error while removing dir")
+      }
+    }
+  }
+}
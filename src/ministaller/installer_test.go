@@ -0,0 +1,183 @@
+package ministaller
+
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "reflect"
+  "runtime"
+  "strings"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+const (
+  testInstallDir = "/install"
+  testPackageDir = "/package"
+)
+
+// newTestTrees creates install and package dirs which differ by
+// every kind of operation: update, remove, move, add and new dir
+func newTestTrees(t *testing.T) *fsutil.MemFS {
+  fsys := fsutil.NewMemFS()
+
+  files := map[string]string{
+    testInstallDir + "/same.txt": "same",
+    testInstallDir + "/update.txt": "old",
+    testInstallDir + "/remove.txt": "remove",
+    testInstallDir + "/old/moved.txt": "moved",
+    testPackageDir + "/same.txt": "same",
+    testPackageDir + "/update.txt": "new",
+    testPackageDir + "/new/moved.txt": "moved",
+    testPackageDir + "/add/added.txt": "added",
+  }
+
+  for name, contents := range files {
+    if err := fsys.WriteFile(name, []byte(contents), fsutil.DefaultFileMode); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if err := fsys.MkdirAll(testPackageDir + "/empty", fsutil.DefaultDirMode); err != nil {
+    t.Fatal(err)
+  }
+
+  return fsys
+}
+
+// snapshot returns contents of every file and dir under root
+func snapshot(t *testing.T, fsys fsutil.FS, root string) map[string]string {
+  tree := make(map[string]string)
+
+  err := fsutil.Walk(fsys, root, func(fullpath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    relpath := strings.TrimPrefix(filepath.ToSlash(fullpath), root)
+    if info.IsDir() {
+      tree[relpath + "/"] = ""
+      return nil
+    }
+
+    data, err := fsutil.ReadFile(fsys, fullpath)
+    tree[relpath] = string(data)
+    return err
+  })
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return tree
+}
+
+// failingHook fails after all files are installed. It runs in the real
+// temp dir since the install dir exists only in MemFS
+var failingHook = &Hook{
+  Command: "sh",
+  Args: []string{"-c", "exit 1"},
+  WorkDir: os.TempDir(),
+  AbortOnFailure: true,
+}
+
+func TestInstallRollback(t *testing.T) {
+  tests := []struct {
+    name string
+    rules []fsutil.FaultRule
+    cancel bool
+    hooks *PackageHooks
+    wantErr bool
+    // some changes cannot be reverted
+    wantRollbackErr bool
+  }{
+    {name: "success"},
+    {name: "journal", rules: []fsutil.FaultRule{{Op: fsutil.OpOpen, Path: JournalFileName}}, wantErr: true},
+    {name: "remove backup", rules: []fsutil.FaultRule{{Op: fsutil.OpRename, Path: testInstallDir + "/remove.txt", After: 1}}, wantErr: true},
+    {name: "move", rules: []fsutil.FaultRule{{Op: fsutil.OpRename, Path: testInstallDir + "/new/moved.txt"}}, wantErr: true},
+    {name: "update backup", rules: []fsutil.FaultRule{{Op: fsutil.OpRename, Path: "update.txt" + BackupExt}}, wantErr: true},
+    {name: "update write", rules: []fsutil.FaultRule{{Op: fsutil.OpWrite, Path: "update.txt" + NewFileExt}}, wantErr: true},
+    {name: "update replace", rules: []fsutil.FaultRule{{Op: fsutil.OpRename, Path: "update.txt" + NewFileExt}}, wantErr: true},
+    {name: "add mkdir", rules: []fsutil.FaultRule{{Op: fsutil.OpMkdir, Path: testInstallDir + "/add"}}, wantErr: true},
+    {name: "add source", rules: []fsutil.FaultRule{{Op: fsutil.OpOpen, Path: testPackageDir + "/add/added.txt"}}, wantErr: true},
+    {name: "add dir", rules: []fsutil.FaultRule{{Op: fsutil.OpMkdir, Path: testInstallDir + "/empty"}}, wantErr: true},
+    {name: "cancel", cancel: true, wantErr: true},
+    {name: "post-install hook", hooks: &PackageHooks{PostInstall: []*Hook{failingHook}}, wantErr: true},
+    {name: "restore move", rules: []fsutil.FaultRule{
+      {Op: fsutil.OpOpen, Path: testPackageDir + "/add/added.txt"},
+      // preflight check and the move itself pass
+      {Op: fsutil.OpRename, Path: testInstallDir + "/old/moved.txt", After: 2},
+    }, wantErr: true, wantRollbackErr: true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if tt.hooks != nil && runtime.GOOS == "windows" {
+        t.Skip("hooks use sh")
+      }
+
+      memfs := newTestTrees(t)
+      before := snapshot(t, memfs, testInstallDir)
+
+      df := NewDiffGenerator(DiffOptions{
+        InstallDir: testInstallDir,
+        PackageDir: testPackageDir,
+        Concurrency: 1,
+        FS: memfs,
+      })
+
+      if err := df.GenerateDiffs(context.Background()); err != nil {
+        t.Fatal(err)
+      }
+
+      faultfs := fsutil.NewFaultFS(memfs, tt.rules...)
+      pi := NewPackageInstaller(InstallOptions{
+        InstallDir: testInstallDir,
+        PackageDir: testPackageDir,
+        CopyConcurrency: 2,
+        FS: faultfs,
+        Hooks: tt.hooks,
+        InUse: UnlinkStrategy{},
+      })
+
+      ctx, cancel := context.WithCancel(context.Background())
+      defer cancel()
+      if tt.cancel {
+        cancel()
+      }
+
+      err := pi.Install(ctx, df)
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("unexpected install error: %v", err)
+      }
+
+      if len(tt.rules) > 0 && faultfs.Injected() == 0 {
+        t.Fatal("fault was not injected")
+      }
+
+      if _, ok := err.(*RollbackError); ok != tt.wantRollbackErr {
+        t.Fatalf("unexpected rollback error: %v", err)
+      }
+
+      if tt.wantRollbackErr {
+        // journal is kept so the rollback can be retried
+        if _, err := memfs.Lstat(testInstallDir + "/" + JournalFileName); err != nil {
+          t.Fatalf("journal was removed: %v", err)
+        }
+
+        return
+      }
+
+      after := snapshot(t, memfs, testInstallDir)
+
+      expected := before
+      if tt.name == "success" {
+        expected = snapshot(t, memfs, testPackageDir)
+      }
+
+      if !reflect.DeepEqual(after, expected) {
+        t.Fatalf("install dir is %v, expected %v", after, expected)
+      }
+    })
+  }
+}
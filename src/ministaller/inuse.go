@@ -0,0 +1,171 @@
+package ministaller
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "os"
+  "path"
+  "strings"
+  "sync"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // PendingFileName lists files set aside because they were in use,
+  // they are removed by the next install
+  PendingFileName = ".ministaller.pending"
+  // in-use files are renamed to name with this suffix
+  asideExt = ".ministaller-old"
+)
+
+// InUseStrategy replaces and removes files which can be in use
+// by running processes, e.g. executables and libraries on Windows
+type InUseStrategy interface {
+  // Replace renames src over dst
+  Replace(fsys fsutil.FS, src, dst string) error
+  // Remove removes the file now or as soon as it is not in use
+  Remove(fsys fsutil.FS, fullpath string) error
+  // Cleanup removes files which could not be removed by previous installs
+  Cleanup(fsys fsutil.FS)
+}
+
+// UnlinkStrategy relies on Unix semantics: files in use can be
+// unlinked and replaced, running processes keep the old contents
+type UnlinkStrategy struct {}
+
+func (UnlinkStrategy) Replace(fsys fsutil.FS, src, dst string) error {
+  return fsys.Rename(src, dst)
+}
+
+func (UnlinkStrategy) Remove(fsys fsutil.FS, fullpath string) error {
+  return fsys.Remove(fullpath)
+}
+
+func (UnlinkStrategy) Cleanup(fsys fsutil.FS) {
+  // nothing is ever left
+}
+
+// RenameAsideStrategy is used where files in use cannot be overwritten
+// or removed, but can be renamed (Windows). Such files are renamed aside
+// and their removal is scheduled on reboot and on the next install
+type RenameAsideStrategy struct {
+  // pending removals are recorded here
+  InstallDir string
+  // schedules removal of the file after reboot, can be nil
+  RemoveOnReboot func(fullpath string) error
+
+  mutex sync.Mutex
+}
+
+func (ras *RenameAsideStrategy) Replace(fsys fsutil.FS, src, dst string) error {
+  err := fsys.Rename(src, dst)
+  if err == nil {
+    return nil
+  }
+
+  if _, serr := fsys.Lstat(dst); serr != nil {
+    return err
+  }
+
+  entry := logging.WithFields(logging.Fields{logging.FieldOp: "replace", logging.FieldPath: dst, logging.FieldError: err})
+  entry.Warnf("File is probably in use, renaming it aside")
+
+  if err = ras.Remove(fsys, dst); err != nil {
+    return err
+  }
+
+  return fsys.Rename(src, dst)
+}
+
+func (ras *RenameAsideStrategy) Remove(fsys fsutil.FS, fullpath string) error {
+  err := fsys.Remove(fullpath)
+  if err == nil || os.IsNotExist(err) {
+    return err
+  }
+
+  asidepath := fmt.Sprintf("%v%v%v", fullpath, asideExt, time.Now().UnixNano())
+  if rerr := fsys.Rename(fullpath, asidepath); rerr != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "rename-aside", logging.FieldPath: fullpath, logging.FieldError: rerr}).Errorf("Failed to rename file aside")
+    return err
+  }
+
+  entry := logging.WithFields(logging.Fields{logging.FieldOp: "rename-aside", logging.FieldPath: asidepath})
+  entry.Infof("Renamed in-use file aside")
+
+  if ras.RemoveOnReboot != nil {
+    if rerr := ras.RemoveOnReboot(asidepath); rerr != nil {
+      entry.WithError(rerr).Warnf("Failed to schedule removal on reboot")
+    }
+  }
+
+  // removal on reboot needs admin rights, so next install tries too
+  ras.addPending(fsys, asidepath)
+  return nil
+}
+
+func (ras *RenameAsideStrategy) addPending(fsys fsutil.FS, asidepath string) {
+  ras.mutex.Lock()
+  defer ras.mutex.Unlock()
+
+  pendingPath := path.Join(ras.InstallDir, PendingFileName)
+  f, err := fsys.OpenFile(pendingPath, os.O_WRONLY | os.O_CREATE | os.O_APPEND, fsutil.DefaultFileMode)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: pendingPath, logging.FieldError: err}).Warnf("Failed to record pending removal")
+    return
+  }
+
+  defer f.Close()
+  f.Write([]byte(asidepath + "\n"))
+}
+
+// isAsideFile checks whether the file was renamed aside by RenameAsideStrategy
+func isAsideFile(name string) bool {
+  return strings.Contains(path.Base(name), asideExt)
+}
+
+func (ras *RenameAsideStrategy) Cleanup(fsys fsutil.FS) {
+  ras.mutex.Lock()
+  defer ras.mutex.Unlock()
+
+  pendingPath := path.Join(ras.InstallDir, PendingFileName)
+  data, err := fsutil.ReadFile(fsys, pendingPath)
+  if err != nil {
+    return
+  }
+
+  left := make([]string, 0)
+  scanner := bufio.NewScanner(bytes.NewReader(data))
+
+  for scanner.Scan() {
+    asidepath := strings.TrimSpace(scanner.Text())
+    // never touch anything what was not renamed aside
+    if !isAsideFile(asidepath) {
+      continue
+    }
+
+    err := fsys.Remove(asidepath)
+    if err != nil && !os.IsNotExist(err) {
+      logging.WithFields(logging.Fields{logging.FieldOp: "cleanup", logging.FieldPath: asidepath, logging.FieldError: err}).Warnf("File is still in use")
+      left = append(left, asidepath)
+      continue
+    }
+
+    logging.WithFields(logging.Fields{logging.FieldOp: "cleanup", logging.FieldPath: asidepath}).Infof("Removed file left by previous install")
+  }
+
+  if len(left) == 0 {
+    fsys.Remove(pendingPath)
+    return
+  }
+
+  f, err := fsys.OpenFile(pendingPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, fsutil.DefaultFileMode)
+  if err != nil {
+    return
+  }
+
+  defer f.Close()
+  f.Write([]byte(strings.Join(left, "\n") + "\n"))
+}
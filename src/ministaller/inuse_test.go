@@ -0,0 +1,199 @@
+package ministaller
+
+import (
+  "context"
+  "path"
+  "strings"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+// asideFiles returns names of files renamed aside in dir
+func asideFiles(t *testing.T, fsys fsutil.FS, dir string) []string {
+  entries, err := fsys.ReadDir(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  names := make([]string, 0)
+  for _, fi := range entries {
+    if isAsideFile(fi.Name()) {
+      names = append(names, fi.Name())
+    }
+  }
+
+  return names
+}
+
+func pendingFiles(fsys fsutil.FS) []string {
+  data, err := fsutil.ReadFile(fsys, path.Join(testInstallDir, PendingFileName))
+  if err != nil {
+    return nil
+  }
+
+  return strings.Fields(string(data))
+}
+
+func TestRenameAsideRemove(t *testing.T) {
+  tests := []struct {
+    name string
+    rules []fsutil.FaultRule
+    aside int
+    wantErr bool
+  }{
+    {name: "not in use"},
+    {name: "in use", rules: []fsutil.FaultRule{{Op: fsutil.OpRemove, Path: "app.exe"}}, aside: 1},
+    {name: "cannot rename", rules: []fsutil.FaultRule{{Op: fsutil.OpRemove, Path: "app.exe"}, {Op: fsutil.OpRename}}, wantErr: true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      memfs := fsutil.NewMemFS()
+      memfs.WriteFile(testInstallDir + "/app.exe", []byte("app"), fsutil.DefaultFileMode)
+
+      scheduled := make([]string, 0)
+      ras := &RenameAsideStrategy{
+        InstallDir: testInstallDir,
+        RemoveOnReboot: func(fullpath string) error {
+          scheduled = append(scheduled, fullpath)
+          return nil
+        },
+      }
+
+      err := ras.Remove(fsutil.NewFaultFS(memfs, tt.rules...), testInstallDir + "/app.exe")
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("unexpected remove error: %v", err)
+      }
+
+      if _, err := memfs.Lstat(testInstallDir + "/app.exe"); err == nil && !tt.wantErr {
+        t.Fatal("file was not removed")
+      }
+
+      aside := asideFiles(t, memfs, testInstallDir)
+      if len(aside) != tt.aside || len(scheduled) != tt.aside || len(pendingFiles(memfs)) != tt.aside {
+        t.Fatalf("unexpected aside files %v, scheduled %v, pending %v", aside, scheduled, pendingFiles(memfs))
+      }
+    })
+  }
+}
+
+func TestRenameAsideReplace(t *testing.T) {
+  memfs := fsutil.NewMemFS()
+  memfs.WriteFile(testInstallDir + "/app.exe", []byte("old"), fsutil.DefaultFileMode)
+  memfs.WriteFile(testInstallDir + "/app.exe" + NewFileExt, []byte("new"), fsutil.DefaultFileMode)
+
+  // running executable can be neither overwritten nor removed
+  faultfs := fsutil.NewFaultFS(memfs,
+    fsutil.FaultRule{Op: fsutil.OpRename, Path: "app.exe", Times: 1},
+    fsutil.FaultRule{Op: fsutil.OpRemove, Path: "app.exe"})
+
+  ras := &RenameAsideStrategy{InstallDir: testInstallDir}
+  err := ras.Replace(faultfs, testInstallDir + "/app.exe" + NewFileExt, testInstallDir + "/app.exe")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  data, err := fsutil.ReadFile(memfs, testInstallDir + "/app.exe")
+  if err != nil || string(data) != "new" {
+    t.Fatalf("file was not replaced: %q, %v", data, err)
+  }
+
+  if aside := asideFiles(t, memfs, testInstallDir); len(aside) != 1 {
+    t.Fatalf("unexpected aside files %v", aside)
+  }
+}
+
+func TestRenameAsideCleanup(t *testing.T) {
+  memfs := fsutil.NewMemFS()
+  memfs.WriteFile(testInstallDir + "/app.exe" + asideExt + "1", []byte("app"), fsutil.DefaultFileMode)
+  memfs.WriteFile(testInstallDir + "/lib.dll" + asideExt + "2", []byte("lib"), fsutil.DefaultFileMode)
+  memfs.WriteFile(testInstallDir + "/data.txt", []byte("data"), fsutil.DefaultFileMode)
+
+  // only files renamed aside are ever removed
+  pending := []string{
+    testInstallDir + "/app.exe" + asideExt + "1",
+    testInstallDir + "/lib.dll" + asideExt + "2",
+    testInstallDir + "/data.txt",
+  }
+
+  memfs.WriteFile(path.Join(testInstallDir, PendingFileName), []byte(strings.Join(pending, "\n")), fsutil.DefaultFileMode)
+
+  ras := &RenameAsideStrategy{InstallDir: testInstallDir}
+
+  // the application is still running
+  ras.Cleanup(fsutil.NewFaultFS(memfs, fsutil.FaultRule{Op: fsutil.OpRemove, Path: "app.exe" + asideExt + "*"}))
+
+  if aside := asideFiles(t, memfs, testInstallDir); len(aside) != 1 {
+    t.Fatalf("unexpected aside files %v", aside)
+  }
+
+  if left := pendingFiles(memfs); len(left) != 1 || left[0] != pending[0] {
+    t.Fatalf("unexpected pending files %v", left)
+  }
+
+  ras.Cleanup(memfs)
+
+  if aside := asideFiles(t, memfs, testInstallDir); len(aside) != 0 {
+    t.Fatalf("unexpected aside files %v", aside)
+  }
+
+  if _, err := memfs.Lstat(path.Join(testInstallDir, PendingFileName)); err == nil {
+    t.Fatal("pending file was not removed")
+  }
+
+  if _, err := memfs.Lstat(testInstallDir + "/data.txt"); err != nil {
+    t.Fatal("file which was not renamed aside was removed")
+  }
+}
+
+func TestInstallWithFileInUse(t *testing.T) {
+  memfs := newTestTrees(t)
+  ras := &RenameAsideStrategy{InstallDir: testInstallDir}
+
+  generateDiff := func() *DiffGenerator {
+    df := NewDiffGenerator(DiffOptions{
+      InstallDir: testInstallDir,
+      PackageDir: testPackageDir,
+      Concurrency: 1,
+      FS: memfs,
+    })
+
+    if err := df.GenerateDiffs(context.Background()); err != nil {
+      t.Fatal(err)
+    }
+
+    return df
+  }
+
+  // backup of the updated file is still used by the running application
+  faultfs := fsutil.NewFaultFS(memfs, fsutil.FaultRule{Op: fsutil.OpRemove, Path: "update.txt" + BackupExt})
+
+  pi := NewPackageInstaller(InstallOptions{
+    InstallDir: testInstallDir,
+    PackageDir: testPackageDir,
+    CopyConcurrency: 1,
+    FS: faultfs,
+    InUse: ras,
+  })
+
+  if err := pi.Install(context.Background(), generateDiff()); err != nil {
+    t.Fatal(err)
+  }
+
+  if aside := asideFiles(t, memfs, testInstallDir); len(aside) != 1 || len(pendingFiles(memfs)) != 1 {
+    t.Fatalf("unexpected aside files %v, pending %v", aside, pendingFiles(memfs))
+  }
+
+  // files renamed aside and the pending list are not part of the install
+  df := generateDiff()
+  if len(df.FilesToAdd()) + len(df.FilesToRemove()) + len(df.FilesToUpdate()) + len(df.FilesToMove()) != 0 {
+    t.Fatalf("installed dir differs from the package: %v to add, %v to remove, %v to update, %v to move",
+      len(df.FilesToAdd()), len(df.FilesToRemove()), len(df.FilesToUpdate()), len(df.FilesToMove()))
+  }
+
+  ras.Cleanup(memfs)
+
+  if aside := asideFiles(t, memfs, testInstallDir); len(aside) != 0 {
+    t.Fatalf("unexpected aside files %v", aside)
+  }
+}
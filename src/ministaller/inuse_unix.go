@@ -0,0 +1,8 @@
+// +build !windows
+
+package ministaller
+
+// NewInUseStrategy returns the strategy for files in use on this platform
+func NewInUseStrategy(installDir string) InUseStrategy {
+  return UnlinkStrategy{}
+}
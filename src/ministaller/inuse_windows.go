@@ -0,0 +1,10 @@
+package ministaller
+
+import (
+  "github.com/ribtoks/ministaller/src/fsutil"
+)
+
+// NewInUseStrategy returns the strategy for files in use on this platform
+func NewInUseStrategy(installDir string) InUseStrategy {
+  return &RenameAsideStrategy{InstallDir: installDir, RemoveOnReboot: fsutil.RemoveOnReboot}
+}
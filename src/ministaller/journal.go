@@ -0,0 +1,253 @@
+package ministaller
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "encoding/json"
+  "log"
+  "os"
+  "path"
+  "sync"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // JournalFileName is where the install records changes it is about to make
+  // so they can be rolled back if the installer is killed in the middle
+  JournalFileName = ".ministaller.journal"
+)
+
+// journal operations
+const (
+  journalBackup = "backup"
+  journalMove = "move"
+  journalAdd = "add"
+  journalMkdir = "mkdir"
+  // all changes are in place, only backups are left to remove
+  journalCommit = "commit"
+)
+
+const (
+  recoveryStage = "recovery"
+)
+
+var (
+  errInterruptedInstall = errors.New("install was interrupted")
+)
+
+type journalEntry struct {
+  Op string `json:"op"`
+  Path string `json:"path,omitempty"`
+  From string `json:"from,omitempty"`
+  Backup string `json:"backup,omitempty"`
+  // hash of the original file to verify the recovery
+  Sha1 string `json:"sha1,omitempty"`
+}
+
+type installJournal struct {
+  fs fsutil.FS
+  fullpath string
+  file fsutil.File
+  mutex sync.Mutex
+}
+
+func openJournal(fsys fsutil.FS, installDir string) (*installJournal, error) {
+  fullpath := path.Join(installDir, JournalFileName)
+  file, err := fsys.OpenFile(fullpath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, fsutil.DefaultFileMode)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: fullpath, logging.FieldError: err}).Errorf("Failed to create install journal")
+    return nil, err
+  }
+
+  return &installJournal{fs: fsys, fullpath: fullpath, file: file}, nil
+}
+
+// record writes the entry to disk before the operation is made
+func (j *installJournal) record(entry journalEntry) error {
+  if j == nil {
+    return nil
+  }
+
+  data, err := json.Marshal(entry)
+  if err != nil {
+    return err
+  }
+
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  if _, err = j.file.Write(append(data, '\n')); err == nil {
+    err = j.file.Sync()
+  }
+
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: entry.Op, logging.FieldPath: entry.Path, logging.FieldError: err}).Errorf("Failed to write install journal")
+  }
+
+  return err
+}
+
+// close leaves the journal on disk for the recovery
+func (j *installJournal) close() {
+  if j == nil {
+    return
+  }
+
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  j.file.Close()
+}
+
+// remove deletes the journal once install or rollback is complete
+func (j *installJournal) remove() {
+  if j == nil {
+    return
+  }
+
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  j.file.Close()
+  if err := j.fs.Remove(j.fullpath); err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: j.fullpath, logging.FieldError: err}).Warnf("Failed to remove install journal")
+  }
+}
+
+func readJournal(fsys fsutil.FS, fullpath string) ([]journalEntry, error) {
+  data, err := fsutil.ReadFile(fsys, fullpath)
+  if err != nil {
+    return nil, err
+  }
+
+  entries := make([]journalEntry, 0)
+  scanner := bufio.NewScanner(bytes.NewReader(data))
+
+  for scanner.Scan() {
+    var entry journalEntry
+    if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+      // the last line could be written partially
+      logging.WithError(err).Warnf("Skipping malformed journal entry")
+      continue
+    }
+
+    entries = append(entries, entry)
+  }
+
+  return entries, scanner.Err()
+}
+
+// RollbackInterruptedInstall reverts changes of the install into installDir
+// which did not finish, e.g. because the installer was killed. If that install
+// already succeeded, only its backups are removed. Returns false if there
+// was nothing to recover. Restored files are verified against recorded hashes,
+// if some changes cannot be reverted *RollbackError is returned and
+// the journal is kept so the recovery can be retried
+func RollbackInterruptedInstall(fsys fsutil.FS, installDir string) (bool, error) {
+  if fsys == nil {
+    fsys = fsutil.OS
+  }
+
+  journalPath := path.Join(installDir, JournalFileName)
+  entries, err := readJournal(fsys, journalPath)
+  if os.IsNotExist(err) {
+    return false, nil
+  }
+
+  if err != nil {
+    return true, err
+  }
+
+  committed := false
+  for _, entry := range entries {
+    if entry.Op == journalCommit {
+      committed = true
+    }
+  }
+
+  log.Printf("Found journal of interrupted install with %v entries (committed: %v)", len(entries), committed)
+
+  failures := &rollbackFailures{}
+
+  for i := len(entries) - 1; i >= 0; i-- {
+    entry := entries[i]
+    fullpath := path.Join(installDir, entry.Path)
+
+    if committed {
+      if entry.Op == journalBackup {
+        removeIfExists(fsys, path.Join(installDir, entry.Backup))
+      }
+
+      continue
+    }
+
+    switch entry.Op {
+    case journalAdd:
+      removeIfExists(fsys, fullpath + NewFileExt)
+      err := retryOperation(func() error {
+        return fsys.Remove(fullpath)
+      })
+
+      if err != nil && !os.IsNotExist(err) {
+        fileLog(recoveryStage, "purge", entry.Path).WithError(err).Errorf("Error while removing added file")
+        failures.add(entry.Path, err)
+      }
+    case journalBackup:
+      backuppath := path.Join(installDir, entry.Backup)
+      if _, err := fsys.Lstat(backuppath); err != nil {
+        // backup was not made yet
+        continue
+      }
+
+      removeIfExists(fsys, fullpath + NewFileExt)
+      logEntry := fileLog(recoveryStage, "restore", entry.Path)
+      logEntry.Infof("Restoring backup")
+      if err := restoreFile(fsys, backuppath, fullpath, entry.Sha1); err != nil {
+        logEntry.WithError(err).Errorf("Error while restoring backup")
+        failures.add(entry.Path, err)
+      }
+    case journalMove:
+      frompath := path.Join(installDir, entry.From)
+      if _, err := fsys.Lstat(fullpath); err != nil {
+        continue
+      }
+
+      if _, err := fsys.Lstat(frompath); err == nil {
+        continue
+      }
+
+      ensureDirExists(fsys, frompath)
+      logEntry := fileLog(recoveryStage, "move-back", entry.From)
+      logEntry.Infof("Moving back from %v", fullpath)
+      if err := restoreFile(fsys, fullpath, frompath, entry.Sha1); err != nil {
+        logEntry.WithError(err).Errorf("Error while moving back")
+        failures.add(entry.From, err)
+      }
+    case journalMkdir:
+      if entries, err := fsys.ReadDir(fullpath); err == nil && len(entries) == 0 {
+        removeIfExists(fsys, fullpath)
+      }
+    }
+  }
+
+  if list := failures.list(); len(list) > 0 {
+    // the journal is kept to retry the recovery
+    return true, &RollbackError{Err: errInterruptedInstall, Failures: list}
+  }
+
+  if err := fsys.Remove(journalPath); err != nil {
+    return true, err
+  }
+
+  log.Println("Interrupted install was recovered")
+  return true, nil
+}
+
+func removeIfExists(fsys fsutil.FS, fullpath string) {
+  err := fsys.Remove(fullpath)
+  if err != nil && !os.IsNotExist(err) {
+    logging.WithFields(logging.Fields{logging.FieldStage: recoveryStage, logging.FieldPath: fullpath, logging.FieldError: err}).Warnf("Error while removing")
+  }
+}
@@ -0,0 +1,142 @@
+package ministaller
+
+import (
+  "encoding/json"
+  "path"
+  "reflect"
+  "strings"
+  "testing"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/hashing"
+)
+
+// newInterruptedInstall makes the install dir from newTestTrees look like
+// the install was killed after every kind of change was made. Returns
+// the install dir as it was before the install
+func newInterruptedInstall(t *testing.T, committed bool) (*fsutil.MemFS, map[string]string) {
+  memfs := newTestTrees(t)
+  before := snapshot(t, memfs, testInstallDir)
+
+  hash := func(relpath string) string {
+    sha1, err := hashing.HashFile(memfs, path.Join(testInstallDir, relpath))
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    return sha1
+  }
+
+  entries := []journalEntry{
+    {Op: journalBackup, Path: "remove.txt", Backup: "remove.txt" + BackupExt, Sha1: hash("remove.txt")},
+    {Op: journalMkdir, Path: "new"},
+    {Op: journalMove, Path: "new/moved.txt", From: "old/moved.txt", Sha1: hash("old/moved.txt")},
+    {Op: journalBackup, Path: "update.txt", Backup: "update.txt" + BackupExt, Sha1: hash("update.txt")},
+    {Op: journalMkdir, Path: "add"},
+    {Op: journalAdd, Path: "add/added.txt"},
+  }
+
+  if committed {
+    entries = append(entries, journalEntry{Op: journalCommit})
+  }
+
+  renames := [][2]string{
+    {"remove.txt", "remove.txt" + BackupExt},
+    {"old/moved.txt", "new/moved.txt"},
+    {"update.txt", "update.txt" + BackupExt},
+  }
+
+  memfs.MkdirAll(testInstallDir + "/new", fsutil.DefaultDirMode)
+  for _, rename := range renames {
+    if err := memfs.Rename(path.Join(testInstallDir, rename[0]), path.Join(testInstallDir, rename[1])); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  memfs.WriteFile(testInstallDir + "/update.txt", []byte("new"), fsutil.DefaultFileMode)
+  memfs.WriteFile(testInstallDir + "/add/added.txt", []byte("added"), fsutil.DefaultFileMode)
+
+  journal := make([]byte, 0)
+  for _, entry := range entries {
+    data, err := json.Marshal(entry)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    journal = append(append(journal, data...), '\n')
+  }
+
+  // the last entry is written partially
+  journal = append(journal, []byte(`{"op":"add","pa`)...)
+
+  if err := memfs.WriteFile(path.Join(testInstallDir, JournalFileName), journal, fsutil.DefaultFileMode); err != nil {
+    t.Fatal(err)
+  }
+
+  return memfs, before
+}
+
+func TestRollbackInterruptedInstall(t *testing.T) {
+  memfs, before := newInterruptedInstall(t, false)
+
+  recovered, err := RollbackInterruptedInstall(memfs, testInstallDir)
+  if !recovered || err != nil {
+    t.Fatalf("unexpected recovery result %v: %v", recovered, err)
+  }
+
+  if after := snapshot(t, memfs, testInstallDir); !reflect.DeepEqual(after, before) {
+    t.Fatalf("install dir is %v, expected %v", after, before)
+  }
+
+  // nothing is left to recover
+  if recovered, err := RollbackInterruptedInstall(memfs, testInstallDir); recovered || err != nil {
+    t.Fatalf("unexpected second recovery result %v: %v", recovered, err)
+  }
+}
+
+func TestRollbackInterruptedInstallCommitted(t *testing.T) {
+  memfs, _ := newInterruptedInstall(t, true)
+
+  recovered, err := RollbackInterruptedInstall(memfs, testInstallDir)
+  if !recovered || err != nil {
+    t.Fatalf("unexpected recovery result %v: %v", recovered, err)
+  }
+
+  // changes are kept and only backups are removed
+  expected := snapshot(t, memfs, testPackageDir)
+  expected["/old/"] = ""
+  // empty dir was not added before the install was interrupted
+  delete(expected, "/empty/")
+  if after := snapshot(t, memfs, testInstallDir); !reflect.DeepEqual(after, expected) {
+    t.Fatalf("install dir is %v, expected %v", after, expected)
+  }
+}
+
+func TestRollbackInterruptedInstallFailure(t *testing.T) {
+  memfs, before := newInterruptedInstall(t, false)
+
+  faultfs := fsutil.NewFaultFS(memfs, fsutil.FaultRule{Op: fsutil.OpRename, Path: "update.txt" + BackupExt})
+
+  recovered, err := RollbackInterruptedInstall(faultfs, testInstallDir)
+  rerr, ok := err.(*RollbackError)
+  if !recovered || !ok {
+    t.Fatalf("unexpected recovery result %v: %v", recovered, err)
+  }
+
+  if len(rerr.Failures) != 1 || !strings.HasPrefix(rerr.Failures[0], "update.txt:") {
+    t.Fatalf("unexpected rollback failures %v", rerr.Failures)
+  }
+
+  // the journal is kept so the recovery can be retried
+  if _, err := memfs.Lstat(path.Join(testInstallDir, JournalFileName)); err != nil {
+    t.Fatalf("journal was removed: %v", err)
+  }
+
+  recovered, err = RollbackInterruptedInstall(memfs, testInstallDir)
+  if !recovered || err != nil {
+    t.Fatalf("unexpected retried recovery result %v: %v", recovered, err)
+  }
+
+  if after := snapshot(t, memfs, testInstallDir); !reflect.DeepEqual(after, before) {
+    t.Fatalf("install dir is %v, expected %v", after, before)
+  }
+}
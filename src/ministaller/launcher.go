@@ -0,0 +1,112 @@
+package ministaller
+
+import (
+  "errors"
+  "log"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  InstallResultSuccess = "success"
+  InstallResultRolledBack = "rolled-back"
+  // nothing was changed because of failed preflight checks
+  InstallResultAborted = "aborted"
+  InstallResultCancelled = "cancelled"
+  // install failed and some changes could not be reverted
+  InstallResultRollbackIncomplete = "rollback-incomplete"
+)
+
+// LaunchOptions describe the application started after the install
+type LaunchOptions struct {
+  Exe string `json:"exe"`
+  Args []string `json:"args"`
+  WorkDir string `json:"workdir"`
+  Env map[string]string `json:"env"`
+  Detach *bool `json:"detach"`
+}
+
+// InstallResult is passed to the launched application
+// via environment and {result}/{version} placeholders in arguments
+type InstallResult struct {
+  Status string
+  Version string
+}
+
+func (lo *LaunchOptions) isDetached() bool {
+  return (lo.Detach == nil) || *lo.Detach
+}
+
+func (lo *LaunchOptions) expandArgs(result *InstallResult) []string {
+  replacer := strings.NewReplacer(
+    "{result}", result.Status,
+    "{version}", result.Version)
+
+  args := make([]string, 0, len(lo.Args))
+  for _, arg := range lo.Args {
+    args = append(args, replacer.Replace(arg))
+  }
+
+  return args
+}
+
+func LaunchPostInstallExe(options *LaunchOptions, installDir string, result *InstallResult) error {
+  fullpath := filepath.Join(installDir, options.Exe)
+  log.Printf("Trying to launch %v", fullpath)
+
+  fi, err := os.Stat(fullpath)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "launch", logging.FieldPath: fullpath, logging.FieldError: err}).Errorf("Cannot launch")
+    return err
+  }
+
+  if fi.IsDir() {
+    return errors.New("launch-exe points to a directory")
+  }
+
+  cmd := exec.Command(fullpath, options.expandArgs(result)...)
+
+  cmd.Dir = installDir
+  if len(options.WorkDir) > 0 {
+    cmd.Dir = options.WorkDir
+    if !filepath.IsAbs(cmd.Dir) {
+      cmd.Dir = filepath.Join(installDir, cmd.Dir)
+    }
+  }
+
+  cmd.Env = append(os.Environ(),
+    "MINISTALLER_RESULT=" + result.Status,
+    "MINISTALLER_VERSION=" + result.Version)
+  for key, value := range options.Env {
+    cmd.Env = append(cmd.Env, key + "=" + value)
+  }
+
+  detached := options.isDetached()
+  if detached {
+    fsutil.DetachProcess(cmd)
+  }
+
+  err = cmd.Start()
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "launch", logging.FieldPath: fullpath, logging.FieldError: err}).Errorf("Failed to start")
+    return err
+  }
+
+  log.Printf("Launched %v with pid %v", fullpath, cmd.Process.Pid)
+
+  if detached {
+    return cmd.Process.Release()
+  }
+
+  log.Println("Waiting for the launched application to exit")
+  err = cmd.Wait()
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldOp: "launch", logging.FieldPath: fullpath, logging.FieldError: err}).Warnf("Launched application failed")
+  }
+
+  return err
+}
@@ -0,0 +1,52 @@
+package ministaller
+
+import (
+  "errors"
+  "log"
+  "path/filepath"
+  "time"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // lock file in the install dir, it is never part of the diff
+  LockFileName = ".ministaller.lock"
+  lockRetryInterval = 500 * time.Millisecond
+)
+
+var (
+  ErrInstallLocked = errors.New("another install is in progress")
+)
+
+// AcquireInstallLock takes exclusive lock of the install dir waiting
+// up to wait for the other installer to finish
+func AcquireInstallLock(installDir string, wait time.Duration) (*InstallLock, error) {
+  lockPath := filepath.Join(installDir, LockFileName)
+  deadline := time.Now().Add(wait)
+  reported := false
+
+  for {
+    lock, err := tryLock(lockPath)
+    if err == nil {
+      log.Printf("Acquired install lock %v", lockPath)
+      return lock, nil
+    }
+
+    if err != ErrInstallLocked {
+      logging.WithFields(logging.Fields{logging.FieldPath: lockPath, logging.FieldError: err}).Errorf("Failed to lock install dir")
+      return nil, err
+    }
+
+    if time.Now().After(deadline) {
+      logging.WithField(logging.FieldPath, lockPath).Warnf("Install dir is locked by another installer")
+      return nil, err
+    }
+
+    if !reported {
+      log.Printf("Install dir is locked, waiting up to %v", wait)
+      reported = true
+    }
+
+    time.Sleep(lockRetryInterval)
+  }
+}
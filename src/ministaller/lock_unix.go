@@ -0,0 +1,52 @@
+// +build !windows
+
+package ministaller
+
+import (
+  "fmt"
+  "log"
+  "os"
+  "syscall"
+)
+
+type InstallLock struct {
+  path string
+  file *os.File
+}
+
+func tryLock(lockPath string) (*InstallLock, error) {
+  f, err := os.OpenFile(lockPath, os.O_RDWR | os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+  if err != nil {
+    f.Close()
+    if err == syscall.EWOULDBLOCK {
+      return nil, ErrInstallLocked
+    }
+    return nil, err
+  }
+
+  // previous owner could have removed the file while we were waiting for it
+  var fst, pst syscall.Stat_t
+  if syscall.Fstat(int(f.Fd()), &fst) != nil ||
+     syscall.Stat(lockPath, &pst) != nil ||
+     fst.Ino != pst.Ino || fst.Dev != pst.Dev {
+    f.Close()
+    return nil, ErrInstallLocked
+  }
+
+  f.Truncate(0)
+  fmt.Fprintf(f, "%d\n", os.Getpid())
+
+  return &InstallLock{path: lockPath, file: f}, nil
+}
+
+func (l *InstallLock) Release() {
+  log.Printf("Releasing install lock %v", l.path)
+  // removed while still locked so nobody gets lock of the stale file
+  os.Remove(l.path)
+  l.file.Close()
+}
@@ -0,0 +1,89 @@
+// +build !windows
+
+package ministaller
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestInstallLock(t *testing.T) {
+  dir := t.TempDir()
+  lockPath := filepath.Join(dir, LockFileName)
+
+  lock, err := AcquireInstallLock(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  data, err := ioutil.ReadFile(lockPath)
+  if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+    t.Fatalf("lock does not contain pid: %q, %v", data, err)
+  }
+
+  // flock conflicts between open files even in the same process
+  start := time.Now()
+  if _, err := AcquireInstallLock(dir, time.Second); err != ErrInstallLocked {
+    t.Fatalf("second lock returned %v", err)
+  }
+
+  if elapsed := time.Since(start); elapsed < time.Second {
+    t.Fatalf("lock was not waited for, returned after %v", elapsed)
+  }
+
+  lock.Release()
+
+  if _, err := os.Lstat(lockPath); !os.IsNotExist(err) {
+    t.Fatal("lock file was not removed")
+  }
+
+  lock, err = AcquireInstallLock(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  lock.Release()
+}
+
+func TestInstallLockWaitsForRelease(t *testing.T) {
+  dir := t.TempDir()
+
+  lock, err := AcquireInstallLock(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  go func() {
+    time.Sleep(2 * lockRetryInterval)
+    lock.Release()
+  }()
+
+  second, err := AcquireInstallLock(dir, 10 * time.Second)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  second.Release()
+}
+
+func TestInstallLockLeftByDeadProcess(t *testing.T) {
+  dir := t.TempDir()
+
+  // file of the crashed installer is not locked by anybody
+  err := ioutil.WriteFile(filepath.Join(dir, LockFileName), []byte("999999\n"), 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  lock, err := AcquireInstallLock(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  lock.Release()
+}
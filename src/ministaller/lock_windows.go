@@ -0,0 +1,106 @@
+package ministaller
+
+import (
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+const (
+  // owner writes its pid right after creating the lock
+  lockPidTimeout = time.Minute
+  stillActiveExitCode = 259
+)
+
+type InstallLock struct {
+  path string
+  file *os.File
+}
+
+func tryLock(lockPath string) (*InstallLock, error) {
+  f, err := os.OpenFile(lockPath, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+  if os.IsExist(err) {
+    if !isStaleLock(lockPath) {
+      return nil, ErrInstallLocked
+    }
+
+    log.Printf("Removing stale install lock %v", lockPath)
+    if err = os.Remove(lockPath); err != nil {
+      return nil, ErrInstallLocked
+    }
+
+    f, err = os.OpenFile(lockPath, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+    if os.IsExist(err) {
+      return nil, ErrInstallLocked
+    }
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  fmt.Fprintf(f, "%d\n", os.Getpid())
+  f.Sync()
+
+  return &InstallLock{path: lockPath, file: f}, nil
+}
+
+// isStaleLock checks if the process which created the lock is gone.
+// Age of the lock alone means nothing since installs can take long
+func isStaleLock(lockPath string) bool {
+  fi, err := os.Stat(lockPath)
+  if err != nil {
+    return false
+  }
+
+  data, err := ioutil.ReadFile(lockPath)
+  if err != nil {
+    return false
+  }
+
+  pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+  if err != nil {
+    // owner died before writing pid or is just about to write it
+    return time.Since(fi.ModTime()) > lockPidTimeout
+  }
+
+  return !isLockOwnerRunning(pid, fi.ModTime())
+}
+
+// isLockOwnerRunning checks that process pid is alive and was started
+// before the lock was written, otherwise the pid was reused
+func isLockOwnerRunning(pid int, lockedAt time.Time) bool {
+  h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+  if err != nil {
+    return false
+  }
+
+  defer syscall.CloseHandle(h)
+
+  var code uint32
+  if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+    return true
+  }
+
+  if code != stillActiveExitCode {
+    return false
+  }
+
+  var creation, exit, kernel, user syscall.Filetime
+  if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+    return true
+  }
+
+  return time.Unix(0, creation.Nanoseconds()).Before(lockedAt.Add(time.Second))
+}
+
+func (l *InstallLock) Release() {
+  log.Printf("Releasing install lock %v", l.path)
+  l.file.Close()
+  os.Remove(l.path)
+}
@@ -0,0 +1,44 @@
+package ministaller
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "testing"
+  "time"
+)
+
+func TestIsStaleLock(t *testing.T) {
+  tests := []struct {
+    name string
+    contents string
+    age time.Duration
+    stale bool
+  }{
+    {"running owner", strconv.Itoa(os.Getpid()), 0, false},
+    // process started after the lock was written
+    {"reused pid", strconv.Itoa(os.Getpid()), 24 * time.Hour, true},
+    {"dead owner", "999999", 0, true},
+    {"no pid yet", "", 0, false},
+    {"no pid", "", 2 * lockPidTimeout, true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      lockPath := filepath.Join(t.TempDir(), LockFileName)
+      if err := ioutil.WriteFile(lockPath, []byte(tt.contents), 0644); err != nil {
+        t.Fatal(err)
+      }
+
+      lockedAt := time.Now().Add(-tt.age)
+      if err := os.Chtimes(lockPath, lockedAt, lockedAt); err != nil {
+        t.Fatal(err)
+      }
+
+      if stale := isStaleLock(lockPath); stale != tt.stale {
+        t.Fatalf("got stale %v, expected %v", stale, tt.stale)
+      }
+    })
+  }
+}
@@ -0,0 +1,53 @@
+package ministaller
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // optional file in the root of the package describing it
+  PackageManifestName = "ministaller.json"
+)
+
+type PackageManifest struct {
+  Version string `json:"version"`
+  Hooks PackageHooks `json:"hooks"`
+  Launch *LaunchOptions `json:"launch"`
+}
+
+// LoadPackageManifest reads the manifest from the package root and removes
+// it from the package so it is not installed along with the other files
+func LoadPackageManifest(packageDir string) (*PackageManifest, error) {
+  manifest := &PackageManifest{}
+  manifestPath := filepath.Join(packageDir, PackageManifestName)
+
+  data, err := ioutil.ReadFile(manifestPath)
+  if os.IsNotExist(err) {
+    log.Println("Package manifest was not found")
+    return manifest, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  err = json.Unmarshal(data, manifest)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldPath: manifestPath, logging.FieldError: err}).Errorf("Failed to parse package manifest")
+    return nil, err
+  }
+
+  err = os.Remove(manifestPath)
+  if err != nil {
+    return nil, err
+  }
+
+  log.Println("Package manifest loaded")
+
+  return manifest, nil
+}
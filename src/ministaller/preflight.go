@@ -0,0 +1,274 @@
+package ministaller
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  probeExt = ".ministaller-probe"
+  maxReportedOffenders = 10
+  // every file takes at least a block on disk
+  fileSizeOverhead = 4096
+  // free space which should be left after the install
+  diskSpaceReserve = 10 * 1024 * 1024
+)
+
+// PreflightError means install was aborted before touching any file
+type PreflightError struct {
+  reason string
+}
+
+func (pe *PreflightError) Error() string {
+  return pe.reason
+}
+
+func formatBytes(size uint64) string {
+  const unit = 1024
+  if size < unit {
+    return fmt.Sprintf("%d B", size)
+  }
+
+  div, exp := uint64(unit), 0
+  for n := size / unit; n >= unit; n /= unit {
+    div *= unit
+    exp++
+  }
+
+  return fmt.Sprintf("%.1f %cB", float64(size) / float64(div), "KMGTPE"[exp])
+}
+
+// checkFreeSpace fails if the volume of dir has less than required bytes free
+func checkFreeSpace(dir string, required uint64) error {
+  required += diskSpaceReserve
+
+  available, err := fsutil.FreeDiskSpace(dir)
+  if err != nil {
+    // not being able to check is not a reason to refuse the install
+    logging.WithFields(logging.Fields{logging.FieldStage: preflightStage, logging.FieldPath: dir, logging.FieldError: err}).Warnf("Failed to check free space")
+    return nil
+  }
+
+  log.Printf("Space required on volume of %v: %v, available: %v", dir, formatBytes(required), formatBytes(available))
+
+  if available < required {
+    return &PreflightError{
+      reason: fmt.Sprintf("Not enough disk space for %v: %v required, but only %v available",
+        dir, formatBytes(required), formatBytes(available)),
+    }
+  }
+
+  return nil
+}
+
+// requiredInstallSpace calculates peak space needed in the install dir.
+// Removed and updated files are only renamed to backups which are removed
+// in the very end, so all new contents coexist with all old ones
+func requiredInstallSpace(filesProvider UpdateFilesProvider) uint64 {
+  var sum uint64
+
+  for _, fi := range filesProvider.FilesToUpdate() {
+    sum += uint64(fi.FileSize) + fileSizeOverhead
+  }
+
+  for _, fi := range filesProvider.FilesToAdd() {
+    sum += uint64(fi.FileSize) + fileSizeOverhead
+  }
+
+  sum += uint64(len(filesProvider.DirsToAdd())) * fileSizeOverhead
+
+  return sum
+}
+
+// archiveExtractedSize returns the size of the package contents after extraction
+func archiveExtractedSize(src string) (uint64, error) {
+  lower := strings.ToLower(src)
+  if strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+    return tarExtractedSize(src)
+  }
+
+  r, err := zip.OpenReader(src)
+  if err != nil {
+    return 0, err
+  }
+
+  defer r.Close()
+
+  var sum uint64
+  for _, f := range r.File {
+    sum += f.UncompressedSize64 + fileSizeOverhead
+  }
+
+  return sum, nil
+}
+
+func tarExtractedSize(src string) (uint64, error) {
+  f, err := os.Open(src)
+  if err != nil {
+    return 0, err
+  }
+
+  defer f.Close()
+
+  var r io.Reader = f
+  if !strings.HasSuffix(strings.ToLower(src), ".tar") {
+    gzr, err := gzip.NewReader(f)
+    if err != nil {
+      return 0, err
+    }
+
+    defer gzr.Close()
+    r = gzr
+  }
+
+  var sum uint64
+  tr := tar.NewReader(r)
+
+  for {
+    header, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+
+    if err != nil {
+      return 0, err
+    }
+
+    sum += uint64(header.Size) + fileSizeOverhead
+  }
+
+  return sum, nil
+}
+
+// CheckTempSpace makes sure the package can be extracted into tempDir
+func CheckTempSpace(archivePath, tempDir string) error {
+  size, err := archiveExtractedSize(archivePath)
+  if err != nil {
+    logging.WithFields(logging.Fields{logging.FieldStage: preflightStage, logging.FieldPath: archivePath, logging.FieldError: err}).Warnf("Failed to calculate extracted size")
+    return nil
+  }
+
+  return checkFreeSpace(tempDir, size)
+}
+
+// RetryPrompter is implemented by progress handlers which can ask
+// the user to fix the problem (e.g. close the app) and retry
+type RetryPrompter interface {
+  PromptRetry(message string) bool
+}
+
+func (pi *PackageInstaller) preflight(filesProvider UpdateFilesProvider) error {
+  log.Println("Running preflight checks")
+
+  err := checkFreeSpace(pi.installDir, requiredInstallSpace(filesProvider))
+  if err != nil {
+    return err
+  }
+
+  for {
+    offenders := pi.findUnwritableFiles(filesProvider)
+    if len(offenders) == 0 {
+      log.Println("All target files are writable")
+      return nil
+    }
+
+    message := describeOffenders(offenders)
+    logging.WithField(logging.FieldStage, preflightStage).Warnf("%v", message)
+
+    prompter, ok := pi.progressReporter.progressHandler.(RetryPrompter)
+    if ok && prompter.PromptRetry(message) {
+      log.Println("Retrying preflight checks")
+      continue
+    }
+
+    return &PreflightError{reason: message}
+  }
+}
+
+// findUnwritableFiles checks that every file to be changed can be renamed
+// and every directory to be written to is writable
+func (pi *PackageInstaller) findUnwritableFiles(filesProvider UpdateFilesProvider) []string {
+  offenders := make([]string, 0)
+  dirs := make(map[string]bool)
+
+  checkFile := func(relpath string) {
+    dirs[path.Dir(relpath)] = true
+    if err := fsutil.CheckRename(pi.fs, path.Join(pi.installDir, relpath)); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldStage: preflightStage, logging.FieldPath: relpath, logging.FieldError: err}).Warnf("File cannot be changed")
+      offenders = append(offenders, relpath)
+    }
+  }
+
+  for _, fi := range filesProvider.FilesToUpdate() { checkFile(fi.Filepath) }
+  for _, fi := range filesProvider.FilesToRemove() { checkFile(fi.Filepath) }
+
+  for _, mi := range filesProvider.FilesToMove() {
+    checkFile(mi.FromPath)
+    dirs[path.Dir(mi.ToPath)] = true
+  }
+
+  for _, fi := range filesProvider.FilesToAdd() { dirs[path.Dir(fi.Filepath)] = true }
+  for _, di := range filesProvider.DirsToAdd() { dirs[path.Dir(di.Filepath)] = true }
+
+  checked := make(map[string]bool)
+  for dir := range dirs {
+    existing := pi.existingDir(dir)
+    if checked[existing] { continue }
+    checked[existing] = true
+
+    if err := probeWrite(pi.fs, path.Join(pi.installDir, existing)); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldStage: preflightStage, logging.FieldPath: existing, logging.FieldError: err}).Warnf("Directory is not writable")
+      offenders = append(offenders, existing + "/")
+    }
+  }
+
+  sort.Strings(offenders)
+  return offenders
+}
+
+// existingDir returns the closest existing ancestor of the relative dir
+func (pi *PackageInstaller) existingDir(reldir string) string {
+  for ; reldir != "." && reldir != "/"; reldir = path.Dir(reldir) {
+    if fi, err := pi.fs.Stat(path.Join(pi.installDir, reldir)); err == nil && fi.IsDir() {
+      return reldir
+    }
+  }
+
+  return "."
+}
+
+func probeWrite(fsys fsutil.FS, dirpath string) error {
+  probepath := path.Join(dirpath, fmt.Sprintf("%v%v", probeExt, time.Now().UnixNano()))
+  f, err := fsys.OpenFile(probepath, os.O_WRONLY | os.O_CREATE | os.O_EXCL, fsutil.DefaultFileMode)
+  if err != nil {
+    return err
+  }
+
+  f.Close()
+  return fsys.Remove(probepath)
+}
+
+func describeOffenders(offenders []string) string {
+  lines := offenders
+  if len(lines) > maxReportedOffenders {
+    lines = lines[:maxReportedOffenders]
+  }
+
+  message := "The following files are in use or not writable:\n" + strings.Join(lines, "\n")
+  if len(offenders) > len(lines) {
+    message += fmt.Sprintf("\n...and %v more", len(offenders) - len(lines))
+  }
+
+  return message + "\nPlease close applications using them and try again."
+}
@@ -0,0 +1,343 @@
+package ministaller
+
+import (
+  "fmt"
+  "log"
+  "sync"
+  "time"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+// ProgressStage is the part of the install progress is accounted for
+type ProgressStage int
+
+const (
+  RemovingStage ProgressStage = iota
+  MovingStage
+  UpdatingStage
+  AddingStage
+  CleanupStage
+  stagesCount
+)
+
+const (
+  // throughput is recalculated not more often than that
+  throughputSampleInterval = 500 * time.Millisecond
+  // weight of the latest sample in the smoothed throughput
+  throughputSmoothing = 0.3
+  // stats are reported at least that often even if percent did not change
+  statsReportInterval = time.Second
+)
+
+func (s ProgressStage) String() string {
+  switch s {
+  case RemovingStage: return "removing"
+  case MovingStage: return "moving"
+  case UpdatingStage: return "updating"
+  case AddingStage: return "adding"
+  case CleanupStage: return "cleanup"
+  }
+
+  return "unknown"
+}
+
+// ProgressStats is the snapshot of the install progress
+type ProgressStats struct {
+  Percent int
+  Stage ProgressStage
+  StageBytesDone uint64
+  StageBytesTotal uint64
+  BytesDone uint64
+  BytesTotal uint64
+  Throughput float64 // bytes per second, smoothed
+  Remaining time.Duration // 0 if not known yet
+  Elapsed time.Duration
+}
+
+// String describes speed and time left like "2.1 MB/s, about 40 s remaining"
+func (ps *ProgressStats) String() string {
+  if ps.Throughput <= 0 {
+    return "estimating time remaining"
+  }
+
+  speed := formatBytes(uint64(ps.Throughput)) + "/s"
+  if ps.Remaining <= 0 {
+    return speed
+  }
+
+  return fmt.Sprintf("%v, about %v remaining", speed, formatRemaining(ps.Remaining))
+}
+
+func formatRemaining(d time.Duration) string {
+  switch {
+  case d < time.Second:
+    return "less than 1 s"
+  case d < time.Minute:
+    return fmt.Sprintf("%d s", int(d.Seconds() + 0.5))
+  case d < time.Hour:
+    return fmt.Sprintf("%d min", int(d.Minutes() + 0.5))
+  }
+
+  return fmt.Sprintf("%.1f h", d.Hours())
+}
+
+// ProgressHandler is the original handler interface which only
+// knows about percents. Use NewProgressHandlerAdapter to plug it in
+type ProgressHandler interface {
+  HandleSystemMessage(message string)
+  HandlePercentChange(percent int)
+  HandleFinish()
+}
+
+// StatsProgressHandler receives throughput and time estimations
+// in addition to percents
+type StatsProgressHandler interface {
+  HandleSystemMessage(message string)
+  HandleProgress(stats *ProgressStats)
+  HandleFinish()
+}
+
+type progressHandlerAdapter struct {
+  ProgressHandler
+  percent int
+}
+
+// NewProgressHandlerAdapter makes StatsProgressHandler out of ProgressHandler
+// which will be notified only about percent changes
+func NewProgressHandlerAdapter(handler ProgressHandler) StatsProgressHandler {
+  if sh, ok := handler.(StatsProgressHandler); ok {
+    return sh
+  }
+
+  return &progressHandlerAdapter{ProgressHandler: handler}
+}
+
+func (pa *progressHandlerAdapter) HandleProgress(stats *ProgressStats) {
+  if stats.Percent > pa.percent {
+    pa.percent = stats.Percent
+    pa.HandlePercentChange(stats.Percent)
+  }
+}
+
+// progressChunk is the work completed: price is used for percents
+// and bytes for throughput
+type progressChunk struct {
+  stage ProgressStage
+  price int64
+  bytes int64
+}
+
+type ProgressReporter struct {
+  grandTotal uint64
+  currentProgress uint64
+  stageTotals [stagesCount]uint64
+  stageDone [stagesCount]uint64
+  bytesTotal uint64
+  bytesDone uint64
+  stage ProgressStage
+  startTime time.Time
+  lastReport time.Time
+  sampleTime time.Time
+  sampleBytes uint64
+  throughput float64
+  progressChan chan progressChunk
+  progressWG sync.WaitGroup
+  percent int //0..100
+  systemMessageChan chan string
+  finished chan bool
+  progressHandler StatsProgressHandler
+}
+
+type LogProgressHandler struct {
+  percent int
+}
+
+// NewProgressReporter creates reporter which passes progress of the install
+// to handler. Old style ProgressHandler can be wrapped with NewProgressHandlerAdapter
+func NewProgressReporter(handler StatsProgressHandler) *ProgressReporter {
+  if handler == nil {
+    handler = &LogProgressHandler{}
+  }
+
+  pr := &ProgressReporter{
+    progressChan: make(chan progressChunk),
+    systemMessageChan: make(chan string),
+    finished: make(chan bool),
+    progressHandler: handler,
+  }
+
+  go pr.receiveSystemMessages()
+
+  return pr
+}
+
+func (pr *ProgressReporter) setStageTotals(totals [stagesCount]uint64) {
+  pr.stageTotals = totals
+  pr.bytesTotal = 0
+  for _, total := range totals {
+    pr.bytesTotal += total
+  }
+}
+
+func (pr *ProgressReporter) account(chunk progressChunk) {
+  pr.progressWG.Add(1)
+  go func() {
+    pr.progressChan <- chunk
+  }()
+}
+
+func (pr *ProgressReporter) accountRemove(size int64) {
+  pr.account(progressChunk{RemovingStage, (size*RemoveFactor)/100, size})
+}
+
+func (pr *ProgressReporter) accountUpdate(size int64) {
+  pr.account(progressChunk{UpdatingStage, (size*UpdateFactor)/100, size})
+}
+
+func (pr *ProgressReporter) accountAdd(size int64) {
+  pr.account(progressChunk{AddingStage, (size*AddFactor)/100, size})
+}
+
+func (pr *ProgressReporter) accountMove(size int64) {
+  pr.account(progressChunk{MovingStage, MovePrice, size})
+}
+
+// reportFileActivity is called from the workers directly
+// so handlers have to be safe for concurrent use
+func (pr *ProgressReporter) reportFileActivity(action, relpath string) {
+  if fh, ok := pr.progressHandler.(FileActivityHandler); ok {
+    fh.HandleFileActivity(action, relpath)
+  }
+}
+
+func (pr *ProgressReporter) accountBackupRemove() {
+  // exact size of files is not known when removeBackups()
+  // so using some arbitrary value (fair dice roll)
+  pr.account(progressChunk{CleanupStage, RemoveBackupPrice, 0})
+}
+
+func (pr *ProgressReporter) reportingLoop() {
+  pr.startTime = time.Now()
+  pr.sampleTime = pr.startTime
+
+  for chunk := range pr.progressChan {
+    pr.currentProgress += uint64(chunk.price)
+    pr.bytesDone += uint64(chunk.bytes)
+    pr.stageDone[chunk.stage] += uint64(chunk.bytes)
+    pr.stage = chunk.stage
+
+    percent := uint64(100)
+    if pr.grandTotal > 0 {
+      percent = (pr.currentProgress*100) / pr.grandTotal
+    }
+
+    // backups removal is accounted with estimated price
+    if percent > 100 {
+      percent = 100
+    }
+
+    percentsChanged := int(percent) > pr.percent
+    pr.percent = int(percent)
+
+    now := time.Now()
+    pr.updateThroughput(now)
+
+    if percentsChanged || now.Sub(pr.lastReport) >= statsReportInterval {
+      pr.lastReport = now
+      pr.progressHandler.HandleProgress(pr.stats(now))
+    }
+    
+    pr.progressWG.Done()
+  }
+  
+  logging.Debugf("Reporting loop finished")
+}
+
+// updateThroughput keeps exponential moving average of bytes per second
+func (pr *ProgressReporter) updateThroughput(now time.Time) {
+  elapsed := now.Sub(pr.sampleTime)
+  if elapsed < throughputSampleInterval {
+    return
+  }
+
+  current := float64(pr.bytesDone - pr.sampleBytes) / elapsed.Seconds()
+  if pr.throughput == 0 {
+    pr.throughput = current
+  } else {
+    pr.throughput = throughputSmoothing * current + (1 - throughputSmoothing) * pr.throughput
+  }
+
+  pr.sampleTime = now
+  pr.sampleBytes = pr.bytesDone
+}
+
+func (pr *ProgressReporter) stats(now time.Time) *ProgressStats {
+  stats := &ProgressStats{
+    Percent: pr.percent,
+    Stage: pr.stage,
+    StageBytesDone: pr.stageDone[pr.stage],
+    StageBytesTotal: pr.stageTotals[pr.stage],
+    BytesDone: pr.bytesDone,
+    BytesTotal: pr.bytesTotal,
+    Throughput: pr.throughput,
+    Elapsed: now.Sub(pr.startTime),
+  }
+
+  // until the first sample use the average since the start
+  if stats.Throughput == 0 && stats.Elapsed >= throughputSampleInterval {
+    stats.Throughput = float64(pr.bytesDone) / stats.Elapsed.Seconds()
+  }
+
+  if stats.Throughput > 0 && pr.bytesTotal > pr.bytesDone {
+    seconds := float64(pr.bytesTotal - pr.bytesDone) / stats.Throughput
+    stats.Remaining = time.Duration(seconds * float64(time.Second))
+  }
+
+  return stats
+}
+
+func (pr *ProgressReporter) waitProgressReported() {
+  logging.Debugf("Waiting for progress reporting to finish")
+  pr.progressWG.Wait()
+}
+
+func (pr *ProgressReporter) shutdown() {
+  logging.Debugf("Shutting down progress reporter...")
+  close(pr.progressChan)
+  go func() {
+    pr.finished <- true
+  }()
+}
+
+func (pr *ProgressReporter) sendSystemMessage(msg string) {
+  pr.systemMessageChan <- msg
+}
+
+func (pr *ProgressReporter) receiveSystemMessages() {
+  for msg := range pr.systemMessageChan {
+    pr.progressHandler.HandleSystemMessage(msg)
+  }
+  
+  logging.Debugf("System messages handling finished")
+}
+
+func (pr *ProgressReporter) receiveFinish() {
+  logging.Debugf("Waiting for teardown and global finish...")
+  <- pr.finished
+  pr.progressHandler.HandleFinish()
+}
+
+func (ph *LogProgressHandler) HandleProgress(stats *ProgressStats) {
+  if stats.Percent > ph.percent {
+    ph.percent = stats.Percent
+    logging.WithField(logging.FieldStage, stats.Stage.String()).Infof("Completed %v%% (%v)", stats.Percent, stats)
+  }
+}
+
+func (ph *LogProgressHandler) HandleSystemMessage(msg string) {
+  log.Printf("System message: %v", msg)
+}
+
+func (ph *LogProgressHandler) HandleFinish() {
+  log.Println("Finished")
+}
@@ -0,0 +1,237 @@
+package ministaller
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  reportPrefix = "report-"
+  reportExt = ".json"
+  reportTimeLayout = "20060102T150405.000000000"
+)
+
+// ReportOperation is a single change made by the install
+type ReportOperation struct {
+  Op string `json:"op"`
+  Path string `json:"path"`
+  // source of moved file or local copy of the added one
+  From string `json:"from,omitempty"`
+  Size int64 `json:"size"`
+  OldSha1 string `json:"old-sha1,omitempty"`
+  Sha1 string `json:"sha1,omitempty"`
+  Backup string `json:"backup,omitempty"`
+  Error string `json:"error,omitempty"`
+}
+
+// ReportRollback describes the rollback of the failed install
+type ReportRollback struct {
+  Performed bool `json:"performed"`
+  Succeeded bool `json:"succeeded"`
+  Errors []string `json:"errors,omitempty"`
+}
+
+// ReportPackage describes where the package came from
+type ReportPackage struct {
+  Source string `json:"source"`
+  Hash string `json:"hash,omitempty"`
+}
+
+// InstallReport summarizes the install for support purposes.
+// PackageInstaller fills operations, errors and rollback,
+// the rest is up to the caller
+type InstallReport struct {
+  StartTime time.Time `json:"start-time"`
+  EndTime time.Time `json:"end-time"`
+  InstallDir string `json:"install-dir"`
+  Package ReportPackage `json:"package"`
+  FromVersion string `json:"from-version,omitempty"`
+  ToVersion string `json:"to-version,omitempty"`
+  Status string `json:"status"`
+  Operations []*ReportOperation `json:"operations"`
+  Rollback ReportRollback `json:"rollback"`
+  Errors []string `json:"errors,omitempty"`
+  ExitCode int `json:"exit-code"`
+
+  mutex sync.Mutex
+}
+
+func NewInstallReport(installDir string) *InstallReport {
+  return &InstallReport{
+    StartTime: time.Now(),
+    InstallDir: filepath.ToSlash(installDir),
+    Operations: make([]*ReportOperation, 0),
+  }
+}
+
+func (r *InstallReport) addOperation(op *ReportOperation) {
+  if r == nil {
+    return
+  }
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.Operations = append(r.Operations, op)
+}
+
+// AddError records the error which happened during the install
+func (r *InstallReport) AddError(err error) {
+  if r == nil || err == nil {
+    return
+  }
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *InstallReport) startRollback() {
+  if r == nil {
+    return
+  }
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.Rollback.Performed = true
+  r.Rollback.Succeeded = true
+}
+
+func (r *InstallReport) addRollbackError(err error) {
+  if r == nil {
+    return
+  }
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.Rollback.Succeeded = false
+  r.Rollback.Errors = append(r.Rollback.Errors, err.Error())
+}
+
+// Finish sets the outcome of the install
+func (r *InstallReport) Finish(status string, exitCode int) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  r.EndTime = time.Now()
+  r.Status = status
+  r.ExitCode = exitCode
+}
+
+// Save writes the report as JSON to the file
+func (r *InstallReport) Save(fullpath string) error {
+  r.mutex.Lock()
+  data, err := json.MarshalIndent(r, "", "  ")
+  r.mutex.Unlock()
+
+  if err != nil {
+    return err
+  }
+
+  if dir := filepath.Dir(fullpath); len(dir) > 0 {
+    if err = os.MkdirAll(dir, 0755); err != nil {
+      return err
+    }
+  }
+
+  return ioutil.WriteFile(fullpath, append(data, '\n'), 0644)
+}
+
+// SaveToStateDir saves the report into stateDir and removes
+// the oldest ones so only the last keep reports are left there
+func (r *InstallReport) SaveToStateDir(stateDir string, keep int) (string, error) {
+  name := fmt.Sprintf("%v%v%v", reportPrefix, r.StartTime.UTC().Format(reportTimeLayout), reportExt)
+  fullpath := filepath.Join(stateDir, name)
+
+  if err := r.Save(fullpath); err != nil {
+    return "", err
+  }
+
+  names, err := listReports(stateDir)
+  if err != nil {
+    return fullpath, err
+  }
+
+  for keep > 0 && len(names) > keep {
+    oldest := filepath.Join(stateDir, names[0])
+    logging.WithField(logging.FieldPath, oldest).Debugf("Removing old report")
+    if err := os.Remove(oldest); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldPath: oldest, logging.FieldError: err}).Warnf("Failed to remove old report")
+    }
+
+    names = names[1:]
+  }
+
+  return fullpath, nil
+}
+
+// listReports returns names of the reports in stateDir from the oldest
+func listReports(stateDir string) ([]string, error) {
+  entries, err := ioutil.ReadDir(stateDir)
+  if err != nil {
+    return nil, err
+  }
+
+  names := make([]string, 0, len(entries))
+  for _, fi := range entries {
+    name := fi.Name()
+    if !fi.IsDir() && strings.HasPrefix(name, reportPrefix) && strings.HasSuffix(name, reportExt) {
+      names = append(names, name)
+    }
+  }
+
+  // timestamp in the name is sortable
+  sort.Strings(names)
+  return names, nil
+}
+
+// LoadReports reads reports kept in stateDir from the oldest
+func LoadReports(stateDir string) ([]*InstallReport, error) {
+  names, err := listReports(stateDir)
+  if err != nil {
+    return nil, err
+  }
+
+  reports := make([]*InstallReport, 0, len(names))
+  for _, name := range names {
+    data, err := ioutil.ReadFile(filepath.Join(stateDir, name))
+    if err != nil {
+      return nil, err
+    }
+
+    report := &InstallReport{}
+    if err = json.Unmarshal(data, report); err != nil {
+      logging.WithFields(logging.Fields{logging.FieldPath: name, logging.FieldError: err}).Warnf("Skipping malformed report")
+      continue
+    }
+
+    reports = append(reports, report)
+  }
+
+  return reports, nil
+}
+
+// InstalledVersion returns package version of the last successful install
+// into installDir according to reports in stateDir
+func InstalledVersion(stateDir, installDir string) string {
+  reports, err := LoadReports(stateDir)
+  if err != nil {
+    return ""
+  }
+
+  installDir = filepath.ToSlash(installDir)
+  for i := len(reports) - 1; i >= 0; i-- {
+    if reports[i].InstallDir == installDir && reports[i].Status == InstallResultSuccess {
+      return reports[i].ToVersion
+    }
+  }
+
+  return ""
+}
@@ -0,0 +1,130 @@
+package ministaller
+
+import (
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/hashing"
+  "github.com/ribtoks/ministaller/src/logging"
+)
+
+const (
+  // antivirus or indexer can hold the file for a moment
+  rollbackRetryCount = 5
+  rollbackRetryDelay = 100 * time.Millisecond
+)
+
+// RollbackError means install failed and some of its changes
+// could not be reverted. The journal is left in the install dir
+// so the rollback can be retried later
+type RollbackError struct {
+  // the reason of the rollback
+  Err error
+  // descriptions of changes which were not reverted
+  Failures []string
+}
+
+func (re *RollbackError) Error() string {
+  reason := "install failed"
+  if re.Err != nil {
+    reason = re.Err.Error()
+  }
+
+  return fmt.Sprintf("%v; rollback incomplete: %v", reason, strings.Join(re.Failures, "; "))
+}
+
+func (re *RollbackError) Unwrap() error {
+  return re.Err
+}
+
+// ErrorNotifier is implemented by progress handlers which can
+// show the error to the user, e.g. in a message box
+type ErrorNotifier interface {
+  NotifyError(message string)
+}
+
+func (pi *PackageInstaller) notifyError(message string) {
+  if notifier, ok := pi.progressReporter.progressHandler.(ErrorNotifier); ok {
+    notifier.NotifyError(message)
+  } else {
+    pi.progressReporter.sendSystemMessage(message)
+  }
+}
+
+// rollbackFailures collects changes which could not be reverted
+type rollbackFailures struct {
+  mutex sync.Mutex
+  failures []string
+}
+
+func (rf *rollbackFailures) add(relpath string, err error) {
+  rf.mutex.Lock()
+  defer rf.mutex.Unlock()
+  rf.failures = append(rf.failures, fmt.Sprintf("%v: %v", relpath, err))
+}
+
+func (rf *rollbackFailures) list() []string {
+  rf.mutex.Lock()
+  defer rf.mutex.Unlock()
+  return append([]string(nil), rf.failures...)
+}
+
+// retryOperation retries op with growing delay while it fails
+// with something what could be transient
+func retryOperation(op func() error) error {
+  delay := rollbackRetryDelay
+  var err error
+
+  for i := 0; i < rollbackRetryCount; i++ {
+    if err = op(); err == nil || os.IsNotExist(err) {
+      return err
+    }
+
+    logging.WithError(err).Debugf("Retrying in %v", delay)
+    time.Sleep(delay)
+    delay *= 2
+  }
+
+  return err
+}
+
+// verifyRestored checks that the file is in place and has the expected
+// contents. Symlinks and files without recorded hash are only checked to exist
+func verifyRestored(fsys fsutil.FS, fullpath, sha1 string) error {
+  fi, err := fsys.Lstat(fullpath)
+  if err != nil {
+    return err
+  }
+
+  if len(sha1) == 0 || fsutil.IsSymlink(fi.Mode()) {
+    return nil
+  }
+
+  hash, err := hashing.HashFile(fsys, fullpath)
+  if err != nil {
+    return err
+  }
+
+  if hash != sha1 {
+    return fmt.Errorf("hash mismatch after restore: %v expected but %v found", sha1, hash)
+  }
+
+  return nil
+}
+
+// restoreFile renames backup to fullpath retrying transient failures
+// and verifies the result
+func restoreFile(fsys fsutil.FS, backuppath, fullpath, sha1 string) error {
+  err := retryOperation(func() error {
+    return fsys.Rename(backuppath, fullpath)
+  })
+
+  if err == nil {
+    err = verifyRestored(fsys, fullpath, sha1)
+  }
+
+  return err
+}
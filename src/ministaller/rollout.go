@@ -0,0 +1,117 @@
+package ministaller
+
+import (
+  "crypto/rand"
+  "crypto/sha1"
+  "encoding/binary"
+  "encoding/hex"
+  "time"
+)
+
+// update channels from the most to the least stable
+const (
+  StableChannel = "stable"
+  BetaChannel = "beta"
+  NightlyChannel = "nightly"
+)
+
+var channels = []string{StableChannel, BetaChannel, NightlyChannel}
+
+func channelRank(channel string) int {
+  for i, c := range channels {
+    if c == channel {
+      return i
+    }
+  }
+
+  return -1
+}
+
+func IsKnownChannel(channel string) bool {
+  return channelRank(channel) != -1
+}
+
+// ChannelIncludes tells whether releases of the channel are offered to
+// installations subscribed to another one, e.g. beta gets stable too
+func ChannelIncludes(subscribed, channel string) bool {
+  rank := channelRank(channel)
+  return rank != -1 && rank <= channelRank(subscribed)
+}
+
+func (r *FeedRelease) channel() string {
+  if len(r.Channel) == 0 {
+    return StableChannel
+  }
+
+  return r.Channel
+}
+
+// RolledOutTo tells whether the installation falls into the rollout
+// percentage. The same installation always gets the same bucket for
+// the release, so widening the rollout only adds installations
+func (r *FeedRelease) RolledOutTo(installationID string) bool {
+  if r.Rollout == nil {
+    return true
+  }
+
+  key := r.Version
+  if len(key) == 0 {
+    key = r.Hash
+  }
+
+  return RolloutBucket(installationID, key) < *r.Rollout
+}
+
+// RolloutBucket maps the installation to a number in [0, 100)
+// deterministically and uniformly for every key
+func RolloutBucket(installationID, key string) float64 {
+  sum := sha1.Sum([]byte(installationID + ":" + key))
+  // 53 bits fit into float64 exactly
+  value := binary.BigEndian.Uint64(sum[:8]) >> 11
+  return float64(value) / float64(1 << 53) * 100
+}
+
+// InstallationID returns random id of the installation into installDir
+// generating it on the first call. It is kept in the state of the install
+// dir, so copies of the state dir or moved installs do not share ids.
+// The id is generated under the install lock waiting up to lockWait
+// since the install updates the same state
+func InstallationID(installDir string, lockWait time.Duration) (string, error) {
+  state, err := LoadInstallState(installDir)
+  if err != nil {
+    return "", err
+  }
+
+  if len(state.ID) > 0 {
+    return state.ID, nil
+  }
+
+  lock, err := AcquireInstallLock(installDir, lockWait)
+  if err != nil {
+    return "", err
+  }
+
+  defer lock.Release()
+
+  // the install could save the state while we were waiting
+  if state, err = LoadInstallState(installDir); err != nil {
+    return "", err
+  }
+
+  if len(state.ID) > 0 {
+    return state.ID, nil
+  }
+
+  buf := make([]byte, 16)
+  if _, err := rand.Read(buf); err != nil {
+    return "", err
+  }
+
+  state.ID = hex.EncodeToString(buf)
+
+  if err = state.Save(installDir); err != nil {
+    return "", err
+  }
+
+  return state.ID, nil
+}
@@ -0,0 +1,76 @@
+package ministaller
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestRolloutBucket(t *testing.T) {
+  tests := []struct {
+    name string
+    installationID string
+    key string
+  }{
+    {"empty", "", ""},
+    {"version", "05dfdcd9064074022181c56a8837b11e", "2.0"},
+    {"hash", "05dfdcd9064074022181c56a8837b11e", "d6dcf43371b8293bed52a53d3c9e3970285748ed"},
+    {"other installation", "a5a0e4b8e3c4b1f1e0d2c3b4a5968778", "2.0"},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      bucket := RolloutBucket(tt.installationID, tt.key)
+      if bucket < 0 || bucket >= 100 {
+        t.Fatalf("bucket %v is out of range", bucket)
+      }
+
+      if again := RolloutBucket(tt.installationID, tt.key); again != bucket {
+        t.Fatalf("bucket changed from %v to %v", bucket, again)
+      }
+    })
+  }
+}
+
+func TestRolloutBucketDistribution(t *testing.T) {
+  const installations = 10000
+  counts := make([]int, 10)
+
+  for i := 0; i < installations; i++ {
+    counts[int(RolloutBucket(fmt.Sprintf("installation-%v", i), "2.0")) / 10]++
+  }
+
+  // every tenth of the range gets about the same share
+  for i, count := range counts {
+    if count < installations / 10 * 8 / 10 || count > installations / 10 * 12 / 10 {
+      t.Fatalf("%v installations in [%v, %v)", count, i * 10, (i + 1) * 10)
+    }
+  }
+}
+
+func TestChannelIncludes(t *testing.T) {
+  tests := []struct {
+    subscribed string
+    channel string
+    want bool
+  }{
+    {StableChannel, StableChannel, true},
+    {StableChannel, BetaChannel, false},
+    {StableChannel, NightlyChannel, false},
+    {BetaChannel, StableChannel, true},
+    {BetaChannel, BetaChannel, true},
+    {BetaChannel, NightlyChannel, false},
+    {NightlyChannel, StableChannel, true},
+    {NightlyChannel, BetaChannel, true},
+    {NightlyChannel, NightlyChannel, true},
+    {StableChannel, "alpha", false},
+    {"alpha", StableChannel, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.subscribed + "/" + tt.channel, func(t *testing.T) {
+      if got := ChannelIncludes(tt.subscribed, tt.channel); got != tt.want {
+        t.Fatalf("got %v, expected %v", got, tt.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,68 @@
+package ministaller
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+const (
+  // state of the installation in the install dir, it is never part of the diff
+  StateFileName = ".ministaller.state"
+)
+
+// InstallState describes what is installed into the install dir. It is
+// kept in the install dir so it does not depend on reports rotation
+type InstallState struct {
+  // random id of the installation used for staged rollouts
+  ID string `json:"id,omitempty"`
+  Version string `json:"version,omitempty"`
+  // sha1 of the installed package
+  PackageHash string `json:"package-hash,omitempty"`
+  InstalledAt *time.Time `json:"installed-at,omitempty"`
+}
+
+// LoadInstallState reads the state of installDir,
+// empty state is returned if nothing was installed yet
+func LoadInstallState(installDir string) (*InstallState, error) {
+  state := &InstallState{}
+
+  data, err := ioutil.ReadFile(filepath.Join(installDir, StateFileName))
+  if os.IsNotExist(err) {
+    return state, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  if err = json.Unmarshal(data, state); err != nil {
+    return nil, err
+  }
+
+  return state, nil
+}
+
+// Save writes the state into installDir replacing the previous one atomically
+func (s *InstallState) Save(installDir string) error {
+  data, err := json.MarshalIndent(s, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  fullpath := filepath.Join(installDir, StateFileName)
+  tmppath := fullpath + NewFileExt
+
+  if err = ioutil.WriteFile(tmppath, data, 0644); err != nil {
+    return err
+  }
+
+  if err = os.Rename(tmppath, fullpath); err != nil {
+    os.Remove(tmppath)
+    return err
+  }
+
+  return nil
+}
@@ -0,0 +1,189 @@
+package ministaller
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "unicode/utf8"
+)
+
+const (
+  progressBarWidth = 30
+  defaultTerminalWidth = 100
+  // interactive bar is not redrawn more often than that
+  terminalRedrawInterval = 100 * time.Millisecond
+  // plain output prints a line at least every such percents or time
+  plainPercentStep = 10
+  plainLineInterval = 5 * time.Second
+)
+
+// FileActivityHandler is implemented by progress handlers
+// which show the file being processed
+type FileActivityHandler interface {
+  HandleFileActivity(action, relpath string)
+}
+
+// TerminalProgressHandler renders live progress bar when output is a terminal
+// and periodic plain lines otherwise (e.g. in CI logs)
+type TerminalProgressHandler struct {
+  out io.Writer
+  interactive bool
+  width int
+  mutex sync.Mutex
+  stage string
+  activity string
+  percent int
+  stats *ProgressStats
+  filesDone int
+  startTime time.Time
+  lastRender time.Time
+  lastPlainPercent int
+}
+
+func NewTerminalProgressHandler(out *os.File) *TerminalProgressHandler {
+  return &TerminalProgressHandler{
+    out: out,
+    interactive: IsTerminal(out),
+    width: terminalWidth(),
+    startTime: time.Now(),
+    lastPlainPercent: -plainPercentStep,
+  }
+}
+
+func IsTerminal(f *os.File) bool {
+  fi, err := f.Stat()
+  if err != nil {
+    return false
+  }
+
+  return fi.Mode() & os.ModeCharDevice != 0
+}
+
+func terminalWidth() int {
+  if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 20 {
+    return columns
+  }
+
+  return defaultTerminalWidth
+}
+
+func (th *TerminalProgressHandler) HandleSystemMessage(msg string) {
+  th.mutex.Lock()
+  defer th.mutex.Unlock()
+
+  th.stage = msg
+  th.activity = ""
+
+  if th.interactive {
+    th.render(true)
+  } else {
+    fmt.Fprintf(th.out, "%v\n", msg)
+  }
+}
+
+func (th *TerminalProgressHandler) HandleProgress(stats *ProgressStats) {
+  th.mutex.Lock()
+  defer th.mutex.Unlock()
+
+  th.percent = stats.Percent
+  th.stats = stats
+
+  if th.interactive {
+    th.render(false)
+  } else {
+    th.printPlainLine(false)
+  }
+}
+
+func (th *TerminalProgressHandler) HandleFileActivity(action, relpath string) {
+  th.mutex.Lock()
+  defer th.mutex.Unlock()
+
+  th.activity = action + " " + relpath
+  th.filesDone++
+
+  if th.interactive {
+    th.render(false)
+  } else {
+    th.printPlainLine(false)
+  }
+}
+
+func (th *TerminalProgressHandler) HandleFinish() {
+  th.mutex.Lock()
+  defer th.mutex.Unlock()
+
+  th.activity = ""
+
+  if th.interactive {
+    th.render(true)
+    fmt.Fprintln(th.out)
+  } else {
+    th.printPlainLine(true)
+  }
+
+  fmt.Fprintf(th.out, "Finished in %v\n", time.Since(th.startTime).Round(time.Second))
+}
+
+func (th *TerminalProgressHandler) statusLine() string {
+  parts := []string{
+    fmt.Sprintf("%3d%%", th.percent),
+    th.stage,
+    fmt.Sprintf("%d files", th.filesDone),
+  }
+
+  if th.stats != nil && th.percent < 100 {
+    parts = append(parts, th.stats.String())
+  }
+
+  return strings.Join(parts, " | ")
+}
+
+func (th *TerminalProgressHandler) render(force bool) {
+  now := time.Now()
+  if !force && now.Sub(th.lastRender) < terminalRedrawInterval {
+    return
+  }
+
+  th.lastRender = now
+
+  filled := th.percent * progressBarWidth / 100
+  bar := "[" + strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth - filled) + "] "
+
+  line := bar + th.statusLine()
+  if len(th.activity) > 0 {
+    line += " | " + th.activity
+  }
+
+  // leave the last column empty so the terminal does not wrap
+  line = truncateRunes(line, th.width - 1)
+
+  fmt.Fprintf(th.out, "\r%-*s", th.width - 1, line)
+}
+
+// truncateRunes cuts s to at most n runes so multibyte
+// characters (e.g. in file names) are never split
+func truncateRunes(s string, n int) string {
+  if utf8.RuneCountInString(s) <= n {
+    return s
+  }
+
+  return string([]rune(s)[:n])
+}
+
+func (th *TerminalProgressHandler) printPlainLine(force bool) {
+  now := time.Now()
+  percentStep := th.percent - th.lastPlainPercent >= plainPercentStep
+  if !force && !percentStep && now.Sub(th.lastRender) < plainLineInterval {
+    return
+  }
+
+  th.lastRender = now
+  th.lastPlainPercent = th.percent
+
+  fmt.Fprintln(th.out, th.statusLine())
+}
@@ -0,0 +1,39 @@
+package ministaller
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "unicode/utf8"
+)
+
+func TestTerminalProgressRender(t *testing.T) {
+  tests := []struct {
+    name string
+    activity string
+  }{
+    {"ascii", "copying " + strings.Repeat("a", 100)},
+    {"cyrillic", "copying " + strings.Repeat("файл", 30)},
+    {"cjk", "copying " + strings.Repeat("文件", 30)},
+    {"emoji", "copying " + strings.Repeat("📁", 50)},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      for width := 40; width < 50; width++ {
+        out := &bytes.Buffer{}
+        th := &TerminalProgressHandler{out: out, interactive: true, width: width, activity: tt.activity}
+        th.render(true)
+
+        line := strings.TrimPrefix(out.String(), "\r")
+        if !utf8.ValidString(line) {
+          t.Fatalf("line of width %v is not valid UTF-8: %q", width, line)
+        }
+
+        if runes := utf8.RuneCountInString(line); runes != width - 1 {
+          t.Fatalf("line has %v runes, expected %v", runes, width - 1)
+        }
+      }
+    })
+  }
+}
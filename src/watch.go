@@ -0,0 +1,370 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "math/rand"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+  "github.com/ribtoks/ministaller/src/fsutil"
+  "github.com/ribtoks/ministaller/src/logging"
+  "github.com/ribtoks/ministaller/src/ministaller"
+)
+
+const (
+  // how often to recheck whether downloaded update can be installed
+  applyPollInterval = time.Minute
+  maxFeedSize = 1024 * 1024
+)
+
+// timeWindow is the time of day range, it can span midnight
+type timeWindow struct {
+  from time.Duration
+  to time.Duration
+}
+
+func parseTimeWindow(s string) (*timeWindow, error) {
+  parts := strings.Split(s, "-")
+  if len(parts) != 2 {
+    return nil, fmt.Errorf("invalid time window %v, expected HH:MM-HH:MM", s)
+  }
+
+  tw := &timeWindow{}
+  bounds := []*time.Duration{&tw.from, &tw.to}
+
+  for i, part := range parts {
+    t, err := time.Parse("15:04", strings.TrimSpace(part))
+    if err != nil {
+      return nil, fmt.Errorf("invalid time window %v, expected HH:MM-HH:MM", s)
+    }
+
+    *bounds[i] = time.Duration(t.Hour()) * time.Hour + time.Duration(t.Minute()) * time.Minute
+  }
+
+  return tw, nil
+}
+
+func (tw *timeWindow) contains(t time.Time) bool {
+  offset := time.Duration(t.Hour()) * time.Hour + time.Duration(t.Minute()) * time.Minute
+
+  if tw.from <= tw.to {
+    return offset >= tw.from && offset < tw.to
+  }
+
+  return offset >= tw.from || offset < tw.to
+}
+
+// readyPackage is downloaded and verified release waiting for install
+type readyPackage struct {
+  release *ministaller.FeedRelease
+  path string
+}
+
+func validateWatch() error {
+  if err := validateInstallPath(); err != nil {
+    return err
+  }
+
+  if len(feedFlag) == 0 { return errors.New("feed is required") }
+  if len(stateDirFlag) == 0 { return errors.New("state-dir is required") }
+  if watchIntervalFlag <= 0 { return errors.New("watch-interval should be positive") }
+  if watchJitterFlag < 0 { return errors.New("watch-jitter should not be negative") }
+  if !ministaller.IsKnownChannel(channelFlag) { return fmt.Errorf("unknown channel %v", channelFlag) }
+
+  if len(applyWindowFlag) > 0 {
+    if _, err := parseTimeWindow(applyWindowFlag); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func runWatch(ctx context.Context, cancel context.CancelFunc) int {
+  rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+  // validated while parsing flags
+  window, _ := parseTimeWindow(applyWindowFlag)
+  if len(applyWindowFlag) == 0 {
+    window = nil
+  }
+
+  var ready *readyPackage
+  // broken releases are not retried until a newer one appears
+  failedHashes := make(map[string]bool)
+
+  nextCheck := time.Now()
+  if !onceFlag {
+    // clients started at the same time should not come all together
+    nextCheck = nextCheck.Add(jitter(rnd))
+  }
+
+  for {
+    if !time.Now().Before(nextCheck) {
+      pkg, err := checkFeed(ctx, failedHashes)
+      if err != nil {
+        if ctx.Err() != nil {
+          return exitCodeSuccess
+        }
+
+        logging.WithError(err).Errorf("Failed to check for updates")
+        if onceFlag {
+          return exitCodeFailure
+        }
+      } else {
+        ready = pkg
+      }
+
+      nextCheck = time.Now().Add(watchIntervalFlag + jitter(rnd))
+    }
+
+    if ready != nil && canApply(window) {
+      exitCode := applyUpdate(ctx, cancel, ready)
+      // locked install dir and temporary preflight
+      // conditions (e.g. low disk space) are retried on the next check
+      switch exitCode {
+      case exitCodeSuccess, exitCodeCancelled, exitCodeLocked, exitCodeAborted:
+      default:
+        failedHashes[ready.release.Hash] = true
+      }
+
+      ready = nil
+
+      if onceFlag || ctx.Err() != nil {
+        return exitCode
+      }
+    }
+
+    if onceFlag {
+      if ready != nil {
+        fmt.Printf("Update %v is downloaded and waits to be installed\n", ready.release.Version)
+        return exitCodeUpdateAvailable
+      }
+
+      return exitCodeSuccess
+    }
+
+    wait := time.Until(nextCheck)
+    if ready != nil && wait > applyPollInterval {
+      wait = applyPollInterval
+    }
+
+    timer := time.NewTimer(wait)
+    select {
+    case <- timer.C:
+    case <- ctx.Done():
+      timer.Stop()
+      log.Println("Watching stopped")
+      return exitCodeSuccess
+    }
+  }
+}
+
+func jitter(rnd *rand.Rand) time.Duration {
+  if watchJitterFlag <= 0 {
+    return 0
+  }
+
+  return time.Duration(rnd.Int63n(int64(watchJitterFlag)))
+}
+
+// checkFeed finds the latest release and downloads it if it is not
+// installed yet. Returns nil if there is nothing to install
+func checkFeed(ctx context.Context, failedHashes map[string]bool) (*readyPackage, error) {
+  log.Printf("Checking feed %v", feedFlag)
+
+  feed, err := loadFeed(ctx, feedFlag)
+  if err != nil {
+    return nil, err
+  }
+
+  installationID, err := ministaller.InstallationID(installPathFlag, lockWaitFlag)
+  if err != nil {
+    return nil, err
+  }
+
+  release, err := feed.Latest(channelFlag, installationID)
+  if err == ministaller.ErrNoRelease {
+    log.Printf("No release is available in %v channel", channelFlag)
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  entry := logging.WithFields(logging.Fields{"version": release.Version, "channel": channelFlag})
+
+  if isInstalled(release) {
+    entry.Infof("Latest release is installed")
+    return nil, nil
+  }
+
+  if failedHashes[release.Hash] {
+    entry.Warnf("Skipping release which failed to install")
+    return nil, nil
+  }
+
+  entry.Infof("Found new release")
+
+  pkgPath, err := fetchRelease(ctx, release, releaseLocation(feedFlag, release.URL))
+  if err != nil {
+    return nil, err
+  }
+
+  return &readyPackage{release: release, path: pkgPath}, nil
+}
+
+// isInstalled compares the release with the state of the install dir
+func isInstalled(release *ministaller.FeedRelease) bool {
+  state, err := ministaller.LoadInstallState(installPathFlag)
+  if err != nil {
+    logging.WithError(err).Warnf("Failed to read install state")
+    return false
+  }
+
+  if strings.EqualFold(state.PackageHash, release.Hash) {
+    return true
+  }
+
+  if len(state.Version) == 0 || len(release.Version) == 0 {
+    return false
+  }
+
+  return ministaller.CompareVersions(release.Version, state.Version) <= 0
+}
+
+func loadFeed(ctx context.Context, location string) (*ministaller.Feed, error) {
+  var data []byte
+  var err error
+
+  if isRemote(location) {
+    data, err = fetchURL(ctx, location)
+  } else {
+    data, err = ioutil.ReadFile(location)
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  return ministaller.ParseFeed(data)
+}
+
+func fetchURL(ctx context.Context, remoteAddr string) ([]byte, error) {
+  req, err := http.NewRequest("GET", remoteAddr, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+  if err != nil {
+    return nil, err
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("unexpected response status: %v", resp.Status)
+  }
+
+  return ioutil.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+func isRemote(location string) bool {
+  lower := strings.ToLower(location)
+  return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// releaseLocation resolves url of the release relative to the feed
+func releaseLocation(feedLocation, releaseURL string) string {
+  if isRemote(releaseURL) {
+    return releaseURL
+  }
+
+  if isRemote(feedLocation) {
+    base, err := url.Parse(feedLocation)
+    ref, rerr := url.Parse(releaseURL)
+    if err != nil || rerr != nil {
+      return releaseURL
+    }
+
+    return base.ResolveReference(ref).String()
+  }
+
+  if filepath.IsAbs(releaseURL) {
+    return releaseURL
+  }
+
+  return filepath.Join(filepath.Dir(feedLocation), filepath.FromSlash(releaseURL))
+}
+
+// fetchRelease downloads the release into the package cache
+// and verifies it, already downloaded package is reused
+func fetchRelease(ctx context.Context, release *ministaller.FeedRelease, location string) (string, error) {
+  cache := ministaller.NewPackageCache(stateDirFlag)
+  defer collectGarbage(cache, release.Hash)
+
+  if pkgPath, ok := cache.Lookup(release.Hash); ok {
+    log.Printf("Using already downloaded %v", pkgPath)
+    return pkgPath, nil
+  }
+
+  localPath := location
+  if isRemote(location) {
+    var err error
+    localPath, err = downloadFile(ctx, location, downloadRetryCount)
+    if err != nil {
+      return "", err
+    }
+
+    defer os.Remove(localPath)
+  }
+
+  pkgPath, err := cache.Store(localPath, release.Hash, archiveExt(location))
+  if err != nil {
+    return "", err
+  }
+
+  log.Printf("Release %v is saved to %v", release.Version, pkgPath)
+  return pkgPath, nil
+}
+
+// canApply checks the time window and whether the application is running
+func canApply(window *timeWindow) bool {
+  if window != nil && !window.contains(time.Now()) {
+    log.Printf("Waiting for the %v apply window", applyWindowFlag)
+    return false
+  }
+
+  if len(appExeFlag) > 0 {
+    running, err := fsutil.IsProcessRunning(filepath.Join(installPathFlag, appExeFlag))
+    if err != nil {
+      logging.WithError(err).Warnf("Failed to check whether the application is running")
+      return false
+    }
+
+    if running {
+      log.Printf("Waiting for %v to exit", appExeFlag)
+      return false
+    }
+  }
+
+  return true
+}
+
+// applyUpdate installs the downloaded package like install command
+func applyUpdate(ctx context.Context, cancel context.CancelFunc, ready *readyPackage) int {
+  logging.WithField("version", ready.release.Version).Infof("Installing update")
+
+  packagePathFlag, urlFlag, hashFlag = ready.path, "", ""
+  exitCode := runInstall(ctx, cancel)
+
+  logging.WithFields(logging.Fields{"version": ready.release.Version, "exit-code": exitCode}).Infof("Update install finished")
+  return exitCode
+}